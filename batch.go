@@ -0,0 +1,170 @@
+package memorylanedb
+
+import "github.com/rs/zerolog/log"
+
+type batchOp struct {
+	key    Key
+	value  []byte
+	delete bool
+}
+
+// WriteBatch collects puts and deletes that DB.Write applies atomically:
+// after a crash either every operation of the batch is visible or none is.
+// A WriteBatch is not safe for concurrent use.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (b *WriteBatch) Put(key Key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+func (b *WriteBatch) Delete(key Key) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write appends every operation of the batch to the active datafile followed
+// by a commit entry, then applies them in order. Nothing is written if any
+// operation is invalid.
+func (db *DB) Write(b *WriteBatch) error {
+	if b == nil || len(b.ops) == 0 {
+		return nil
+	}
+	entries, err := db.batchEntries(b)
+	if err != nil {
+		return err
+	}
+	return db.update(func() error {
+		return db.writeBatch(entries)
+	})
+}
+
+// batchEntries validates the operations of b and turns them into entries,
+// ending with the commit entry
+func (db *DB) batchEntries(b *WriteBatch) ([]Entry, error) {
+	entries := make([]Entry, 0, len(b.ops)+1)
+	for _, op := range b.ops {
+		if err := db.validateKey(op.key); err != nil {
+			return nil, err
+		}
+		var entry Entry
+		if op.delete {
+			entry = NewTombstone([]byte(op.key))
+		} else {
+			if len(op.value) > int(db.maxValueSize) {
+				return nil, ErrValueGreaterThanMax
+			}
+			entry = NewEntry([]byte(op.key), op.value)
+		}
+		entry.Flags |= FLAG_BATCH
+		entries = append(entries, entry)
+	}
+	return append(entries, newBatchCommit(len(b.ops))), nil
+}
+
+// writeBatch appends the entries of a batch and applies them; callers must
+// hold mu
+func (db *DB) writeBatch(entries []Entry) error {
+	// the whole batch goes into one datafile, so the commit entry covers it
+	var size int64
+	for i := range entries {
+		size += entries[i].Size()
+	}
+	if err := db.rotateActiveFile(size); err != nil {
+		return err
+	}
+	items := make([]EntryItem, 0, len(entries))
+	for _, entry := range entries {
+		entryItem, err := db.appendEntry(entry)
+		if err != nil {
+			return err
+		}
+		items = append(items, entryItem)
+	}
+
+	now := db.now()
+	for i := range entries {
+		db.applyEntry(&entries[i], items[i], now)
+	}
+	return nil
+}
+
+// newBatchCommit is the entry that commits the batch of n entries before it
+func newBatchCommit(n int) Entry {
+	value := make([]byte, 4)
+	byteOrder.PutUint32(value, uint32(n))
+	entry := NewEntry(nil, value)
+	entry.Flags = FLAG_BATCH_COMMIT
+	return entry
+}
+
+// batchLoader replays batch entries found while scanning a datafile, holding
+// them back until their commit entry is read
+type batchLoader struct {
+	db      *DB
+	df      Datafile
+	pending []EntryWithOffset
+}
+
+// add returns false for entries that are not part of a batch
+func (bl *batchLoader) add(entry EntryWithOffset) bool {
+	switch {
+	case entry.Flags&FLAG_BATCH != 0:
+		bl.pending = append(bl.pending, entry)
+	case entry.Flags&FLAG_BATCH_COMMIT != 0:
+		bl.commit(entry)
+	default:
+		bl.discard()
+		return false
+	}
+	return true
+}
+
+func (bl *batchLoader) commit(commit EntryWithOffset) {
+	// entries of a batch that failed to write can precede the committed one,
+	// the commit entry records how many entries it covers
+	n := 0
+	if len(commit.Value) == 4 {
+		n = int(byteOrder.Uint32(commit.Value))
+	}
+	if n > len(bl.pending) {
+		n = len(bl.pending)
+	}
+	committed := bl.pending[len(bl.pending)-n:]
+	bl.pending = bl.pending[:len(bl.pending)-n]
+	bl.discard()
+
+	now := bl.db.now()
+	for i := range committed {
+		_, entryItem := committed[i].produceRecord(bl.df.ID(), committed[i].Offset, committed[i].EntrySize)
+		bl.db.applyEntry(&committed[i].Entry, entryItem, now)
+	}
+	bl.db.statsFor(uint(bl.df.ID())).DeadBytes += int64(commit.EntrySize)
+}
+
+// discard drops pending entries whose batch was never committed
+func (bl *batchLoader) discard() {
+	if len(bl.pending) == 0 {
+		return
+	}
+	var size int64
+	for _, entry := range bl.pending {
+		size += int64(entry.EntrySize)
+	}
+	bl.db.statsFor(uint(bl.df.ID())).DeadBytes += size
+	log.Warn().Str("datafile", bl.df.Name()).Int("entries", len(bl.pending)).
+		Uint64("offset", bl.pending[0].Offset).Msg("discarding uncommitted batch")
+	bl.pending = nil
+}
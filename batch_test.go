@@ -0,0 +1,130 @@
+package memorylanedb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestWriteBatch(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	db, err := NewDB(directory, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(db.Put("foo", []byte("bar")))
+
+	batch := NewWriteBatch()
+	batch.Put("baz", []byte("qux"))
+	batch.Put("quux", []byte("corge"))
+	batch.Delete("foo")
+	batch.Put("baz", []byte("grault"))
+	assert.Equal(4, batch.Len())
+
+	t.Run("Write", func(t *testing.T) {
+		assert.NoError(db.Write(batch))
+		value, err := db.Get("baz")
+		assert.NoError(err)
+		assert.Equal([]byte("grault"), value)
+		value, err = db.Get("quux")
+		assert.NoError(err)
+		assert.Equal([]byte("corge"), value)
+		_, err = db.Get("foo")
+		assert.ErrorIs(err, ErrKeyNotFound)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		size := db.activeDataFile.Size()
+		invalid := NewWriteBatch()
+		invalid.Put("garply", []byte("waldo"))
+		invalid.Put("", []byte("fred"))
+		assert.ErrorIs(db.Write(invalid), ErrKeyZeroLength)
+		assert.Equal(size, db.activeDataFile.Size())
+		ok, _ := db.Has("garply")
+		assert.False(ok)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert.NoError(db.Close())
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		value, err := db.Get("baz")
+		assert.NoError(err)
+		assert.Equal([]byte("grault"), value)
+		_, err = db.Get("foo")
+		assert.ErrorIs(err, ErrKeyNotFound)
+	})
+	assert.NoError(db.Close())
+}
+
+func TestWriteBatchCrash(t *testing.T) {
+	assert := assert2.New(t)
+
+	t.Run("MissingCommit", func(t *testing.T) {
+		directory := t.TempDir()
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(db.Put("foo", []byte("bar")))
+		batch := NewWriteBatch()
+		batch.Put("foo", []byte("baz"))
+		batch.Put("qux", []byte("quux"))
+		assert.NoError(db.Write(batch))
+		name := db.activeDataFile.Name()
+		assert.NoError(db.Close())
+
+		// crash before the commit entry reached the disk
+		commit := newBatchCommit(batch.Len())
+		path := filepath.Join(directory, name)
+		stat, err := os.Stat(path)
+		assert.NoError(err)
+		assert.NoError(os.Truncate(path, stat.Size()-commit.Size()))
+
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		value, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		_, err = db.Get("qux")
+		assert.ErrorIs(err, ErrKeyNotFound)
+	})
+
+	t.Run("FailedBatchBeforeCommitted", func(t *testing.T) {
+		directory := t.TempDir()
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		// entries of a batch whose write failed halfway
+		entry := NewEntry([]byte("foo"), []byte("bar"))
+		entry.Flags |= FLAG_BATCH
+		_, _, err = db.activeDataFile.Write(entry)
+		assert.NoError(err)
+
+		batch := NewWriteBatch()
+		batch.Put("baz", []byte("qux"))
+		assert.NoError(db.Write(batch))
+		assert.NoError(db.Close())
+
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		_, err = db.Get("foo")
+		assert.ErrorIs(err, ErrKeyNotFound)
+		value, err := db.Get("baz")
+		assert.NoError(err)
+		assert.Equal([]byte("qux"), value)
+	})
+}
@@ -0,0 +1,269 @@
+package memorylanedb
+
+import (
+	"bytes"
+	"context"
+	"sort"
+)
+
+/*
+	Key/value separation: a value larger than Option.BlobThreshold is appended
+	to a blob file, and the datafile entry of its key is flagged FLAG_BLOB and
+	holds a blobPointer instead of the value. Merges then copy the small
+	pointer entries forward and leave the values where they are.
+
+	Blob files are datafiles with their own suffix whose entries hold the key
+	and the value. They share the id space of the datafiles, so snapshots pin
+	them and merges retire them the same way. Only the active blob file is
+	appended to, it is rotated at MaxDatafileSize like the active datafile;
+	the blob files found when the DB is opened are all immutable.
+
+	A merge collects the garbage of the blob files that were immutable when it
+	started, knowing that every pointer into them is in the merged datafiles:
+	- a blob file no live pointer refers to is removed
+	- a blob file whose dead fraction reaches Option.BlobMinDeadRatio, or that
+	  is not encrypted with the newest key, has its live values copied into
+	  new blob files, the merged pointers point at the copies, and it is
+	  removed
+	- any other blob file is left alone
+*/
+
+const (
+	BLOBFILE_SUFFIX = ".blob"
+	// file id, offset and size of the blob file entry holding the value
+	BLOB_POINTER_SIZE = 4 + 8 + 8
+	// DEFAULT_BLOB_MIN_DEAD_RATIO is the BlobMinDeadRatio of a zero Option
+	DEFAULT_BLOB_MIN_DEAD_RATIO = 0.5
+)
+
+var blobfileDefaultName = "%04d" + BLOBFILE_SUFFIX
+
+// blobPointer locates the blob file entry that holds the value of a FLAG_BLOB
+// entry
+type blobPointer struct {
+	fileId uint32
+	offset uint64
+	size   uint64
+}
+
+func (p blobPointer) encode() []byte {
+	buf := make([]byte, BLOB_POINTER_SIZE)
+	byteOrder.PutUint32(buf[0:4], p.fileId)
+	byteOrder.PutUint64(buf[4:12], p.offset)
+	byteOrder.PutUint64(buf[12:20], p.size)
+	return buf
+}
+
+func decodeBlobPointer(value []byte) (blobPointer, error) {
+	if len(value) != BLOB_POINTER_SIZE {
+		return blobPointer{}, ErrCorruptedData
+	}
+	return blobPointer{
+		fileId: byteOrder.Uint32(value[0:4]),
+		offset: byteOrder.Uint64(value[4:12]),
+		size:   byteOrder.Uint64(value[12:20]),
+	}, nil
+}
+
+// pointTo replaces the value of entry with a pointer to its blob, which is
+// compressed if the value was
+func (e *Entry) pointTo(p blobPointer) {
+	e.Value = p.encode()
+	e.ValueSize = BLOB_POINTER_SIZE
+	e.Flags = e.Flags&^COMPRESSOR_FLAGS | FLAG_BLOB
+}
+
+// separates reports whether a value of size bytes goes into the blob log
+func (db *DB) separates(size int64) bool {
+	return db.blobThreshold > 0 && size > int64(db.blobThreshold)
+}
+
+// separateValue moves the value of entry into the active blob file if it is
+// over the threshold, leaving a pointer to it; callers must hold mu
+func (db *DB) separateValue(entry *Entry) error {
+	if entry.Flags&(FLAG_TOMBSTONE|FLAG_BATCH_COMMIT|FLAG_BLOB) != 0 || !db.separates(int64(len(entry.Value))) {
+		return nil
+	}
+	blob := NewEntry(entry.Key, entry.Value)
+	blob.Tstamp = entry.Tstamp
+	blob.setCompressor(entry.Compressor())
+	if err := db.rotateBlobFile(blob.Size()); err != nil {
+		return err
+	}
+	offset, size, err := db.activeBlobFile.Write(blob)
+	if err != nil {
+		return err
+	}
+	entry.pointTo(blobPointer{uint32(db.activeBlobFile.ID()), uint64(offset), uint64(size)})
+	return nil
+}
+
+// rotateBlobFile makes room for size more bytes in the active blob file,
+// sealing a full one and opening a new one if needed; callers must hold mu
+func (db *DB) rotateBlobFile(size int64) error {
+	if bf := db.activeBlobFile; bf != nil {
+		if bf.Size() <= FILE_HEADER_SIZE || bf.Size()+size <= db.maxDatafileSize {
+			return nil
+		}
+		if err := db.sealBlobFile(); err != nil {
+			return err
+		}
+	}
+	defer db.lockReaders()()
+	id := db.maxFileId + 1
+	bf, err := NewDatafile(db.path, id, db.fileOptions(AsBlobFile())...)
+	if err != nil {
+		return err
+	}
+	db.activeBlobFile = bf
+	db.maxFileId = id
+	return nil
+}
+
+// sealBlobFile turns the active blob file into an immutable one; callers must
+// hold mu
+func (db *DB) sealBlobFile() error {
+	defer db.lockReaders()()
+	if err := db.activeBlobFile.Close(); err != nil {
+		return db.fail(err)
+	}
+	id := db.activeBlobFile.ID()
+	bf, err := NewDatafile(db.path, id, append(db.readOnlyOptions(), AsBlobFile())...)
+	if err != nil {
+		return err
+	}
+	db.blobFiles[id] = bf
+	db.activeBlobFile = nil
+	return nil
+}
+
+// blobFile finds an open blob file by id; callers must hold mu or a shard
+// lock of a sharded keyDir
+func (db *DB) blobFile(id int) (Datafile, bool) {
+	if db.activeBlobFile != nil && id == db.activeBlobFile.ID() {
+		return db.activeBlobFile, true
+	}
+	bf, ok := db.blobFiles[id]
+	return bf, ok
+}
+
+// loadBlobFiles opens the blob files in the DB directory, they are only read
+func (db *DB) loadBlobFiles() error {
+	filenames, err := glob(db.fs, db.path, "*"+BLOBFILE_SUFFIX)
+	if err != nil {
+		return err
+	}
+	for _, id := range ExtractIDsFromFilenames(filenames) {
+		bf, err := NewDatafile(db.path, id, append(db.readOnlyOptions(), AsBlobFile())...)
+		if err != nil {
+			return err
+		}
+		db.blobFiles[id] = bf
+		if id > db.maxFileId {
+			db.maxFileId = id
+		}
+	}
+	return nil
+}
+
+// readBlob reads the blob file entry holding the value that the FLAG_BLOB
+// entry points at, from the blob file found by lookup
+func readBlob(entry Entry, lookup func(id int) (Datafile, bool)) (Entry, error) {
+	p, err := decodeBlobPointer(entry.Value)
+	if err != nil {
+		return Entry{}, err
+	}
+	bf, ok := lookup(int(p.fileId))
+	if !ok {
+		return Entry{}, ErrCorruptedData
+	}
+	blob, _, err := bf.ReadFrom(p.offset, p.size)
+	if err != nil {
+		return Entry{}, err
+	}
+	if !bytes.Equal(blob.Key, entry.Key) {
+		return Entry{}, ErrCorruptedData
+	}
+	return blob, nil
+}
+
+// blobGC is what a merge does with the blob files that were immutable when it
+// started
+type blobGC struct {
+	drop  []Datafile       // removed once the merge commits
+	moved map[int]Datafile // drop by id, the live values in them are copied
+}
+
+// planBlobGC finds out how much of every blob file in blobInputs the live
+// pointers of inputs still refer to, and decides which to drop
+func (db *DB) planBlobGC(ctx context.Context, inputs, blobInputs []Datafile) (*blobGC, error) {
+	live := make(map[int]int64)
+	now := db.now()
+	err := db.scanLive(ctx, inputs, func(entry EntryWithOffset, item EntryItem) error {
+		if !entry.IsBlobPointer() || item.isExpired(now) {
+			return nil
+		}
+		p, err := decodeBlobPointer(entry.Value)
+		if err != nil {
+			return err
+		}
+		live[int(p.fileId)] += int64(p.size)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	gc := &blobGC{moved: make(map[int]Datafile)}
+	for _, bf := range blobInputs {
+		used := bf.Size() - FILE_HEADER_SIZE
+		dead := used - live[bf.ID()]
+		if live[bf.ID()] == 0 || float64(dead)/float64(used) >= db.blobMinDeadRatio || db.keys.outdated(bf) {
+			gc.drop = append(gc.drop, bf)
+			gc.moved[bf.ID()] = bf
+		}
+	}
+	return gc, nil
+}
+
+// relocate copies the blob of a live pointer entry into the merged blob files
+// if its blob file is dropped, pointing entry at the copy. The copy is
+// recompressed like the values merged into datafiles.
+func (gc *blobGC) relocate(mw *mergeWriter, entry *Entry) error {
+	p, err := decodeBlobPointer(entry.Value)
+	if err != nil {
+		return err
+	}
+	bf, ok := gc.moved[int(p.fileId)]
+	if !ok {
+		return nil
+	}
+	blob, _, err := bf.ReadFrom(p.offset, p.size)
+	if err != nil {
+		return err
+	}
+	if err := mw.db.recompressValue(&blob); err != nil {
+		return err
+	}
+	moved, err := mw.writeBlob(blob)
+	if err != nil {
+		return err
+	}
+	entry.pointTo(moved)
+	return nil
+}
+
+// immutableBlobFiles returns the immutable blob files, oldest first; callers
+// must hold mu
+func (db *DB) immutableBlobFiles() []Datafile {
+	ids := make([]int, 0, len(db.blobFiles))
+	for id := range db.blobFiles {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	files := make([]Datafile, 0, len(ids))
+	for _, id := range ids {
+		files = append(files, db.blobFiles[id])
+	}
+	return files
+}
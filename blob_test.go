@@ -0,0 +1,133 @@
+package memorylanedb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestBlobLog(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+	opts := &Option{
+		MaxKeySize:       64,
+		MaxValueSize:     4096,
+		MaxDatafileSize:  16 << 10,
+		MaxMergefileSize: 16 << 10,
+		BlobThreshold:    64,
+	}
+	db, err := NewDB(directory, opts)
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() { db.Close() }()
+
+	large := func(i, version int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%d.%d ", i, version)), 1000)[:4000]
+	}
+	check := func(version func(i int) int) {
+		for i := 0; i < 20; i++ {
+			value, err := db.Get(Key(fmt.Sprintf("large%d", i)))
+			assert.NoError(err)
+			assert.Equal(large(i, version(i)), value)
+		}
+		value, err := db.Get("small")
+		assert.NoError(err)
+		assert.Equal([]byte("value"), value)
+	}
+	blobFiles := func() []string {
+		names, _ := filepath.Glob(filepath.Join(directory, "*"+BLOBFILE_SUFFIX))
+		return names
+	}
+
+	assert.NoError(db.Put("small", []byte("value")))
+	for i := 0; i < 18; i++ {
+		assert.NoError(db.Put(Key(fmt.Sprintf("large%d", i)), large(i, 0)))
+	}
+	b := NewWriteBatch()
+	b.Put("large18", large(18, 0))
+	assert.NoError(db.Write(b))
+	assert.NoError(db.PutReader("large19", bytes.NewReader(large(19, 0)), 4000))
+
+	t.Run("Separated", func(t *testing.T) {
+		check(func(int) int { return 0 })
+		// the datafile only holds pointers, the values rotated blob files
+		assert.Less(db.activeDataFile.Size(), int64(4000))
+		assert.Greater(len(blobFiles()), 1)
+
+		r, err := db.GetReader("large19")
+		if !assert.NoError(err) {
+			return
+		}
+		streamed, err := io.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(large(19, 0), streamed)
+		assert.NoError(r.Close())
+	})
+
+	t.Run("MergeKeepsLiveBlobs", func(t *testing.T) {
+		before := blobFiles()
+		assert.NoError(db.Merge(context.Background()))
+		check(func(int) int { return 0 })
+		assert.Equal(before, blobFiles())
+	})
+
+	t.Run("MergeCollectsGarbage", func(t *testing.T) {
+		snap := db.Snapshot()
+		before := db.Stats()["blobBytes"].(int64)
+		// most values of every blob file die
+		for i := 0; i < 20; i++ {
+			if i%4 != 0 {
+				assert.NoError(db.Put(Key(fmt.Sprintf("large%d", i)), []byte("now small")))
+			}
+		}
+		assert.NoError(db.Merge(context.Background()))
+		for i := 0; i < 20; i++ {
+			value, err := db.Get(Key(fmt.Sprintf("large%d", i)))
+			assert.NoError(err)
+			if i%4 != 0 {
+				assert.Equal([]byte("now small"), value)
+			} else {
+				assert.Equal(large(i, 0), value)
+			}
+		}
+		// the dropped blob files are kept for the snapshot
+		value, err := snap.Get("large1")
+		assert.NoError(err)
+		assert.Equal(large(1, 0), value)
+		assert.NoError(snap.Close())
+		retired, _ := filepath.Glob(filepath.Join(directory, OBSOLETE_DIRNAME, "*"))
+		assert.Len(retired, 0)
+		assert.Less(db.Stats()["blobBytes"].(int64), before/2)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert.NoError(db.Close())
+		db, err = NewDB(directory, opts)
+		if !assert.NoError(err) {
+			return
+		}
+		for i := 0; i < 20; i += 4 {
+			assert.NoError(db.Put(Key(fmt.Sprintf("large%d", i)), large(i, 1)))
+		}
+		version := func(i int) int { return 1 }
+		for i := 0; i < 20; i++ {
+			if i%4 != 0 {
+				assert.NoError(db.Put(Key(fmt.Sprintf("large%d", i)), large(i, 1)))
+			}
+		}
+		check(version)
+		assert.NoError(db.Merge(context.Background()))
+		check(version)
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		_, err := NewDB(t.TempDir(), &Option{BlobMinDeadRatio: 1.5})
+		assert.ErrorIs(err, ErrInvalidOption)
+	})
+}
@@ -0,0 +1,338 @@
+package memorylanedb
+
+import "sort"
+
+// BTREE_DEGREE is the minimum degree of the btree index, every node but the
+// root holds between BTREE_DEGREE-1 and 2*BTREE_DEGREE-1 keys
+const BTREE_DEGREE = 32
+
+const btreeMaxItems = 2*BTREE_DEGREE - 1
+
+type btreeItem struct {
+	key  Key
+	item EntryItem
+}
+
+type btreeNode struct {
+	items    []btreeItem
+	children []*btreeNode // empty for leaves
+}
+
+// btreeIndex is an in-memory B-tree keeping keys in lexicographic order
+type btreeIndex struct {
+	root   *btreeNode
+	length int
+}
+
+func newBTreeIndex() *btreeIndex {
+	return &btreeIndex{}
+}
+
+func (t *btreeIndex) Get(key Key) (EntryItem, bool) {
+	n := t.root
+	for n != nil {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].item, true
+		}
+		if n.leaf() {
+			break
+		}
+		n = n.children[i]
+	}
+	return EntryItem{}, false
+}
+
+func (t *btreeIndex) Put(key Key, item EntryItem) {
+	if t.root == nil {
+		t.root = &btreeNode{items: []btreeItem{{key, item}}}
+		t.length = 1
+		return
+	}
+	if len(t.root.items) == btreeMaxItems {
+		old := t.root
+		t.root = &btreeNode{children: []*btreeNode{old}}
+		t.root.splitChild(0)
+	}
+	if t.root.insert(key, item) {
+		t.length++
+	}
+}
+
+func (t *btreeIndex) Delete(key Key) {
+	if t.root == nil {
+		return
+	}
+	if t.root.remove(key) {
+		t.length--
+	}
+	if len(t.root.items) == 0 {
+		if t.root.leaf() {
+			t.root = nil
+		} else {
+			t.root = t.root.children[0]
+		}
+	}
+}
+
+func (t *btreeIndex) Len() int {
+	return t.length
+}
+
+func (t *btreeIndex) Range(fn func(key Key, item EntryItem) bool) {
+	t.Ascend("", "", fn)
+}
+
+func (t *btreeIndex) Ascend(start, end Key, fn func(key Key, item EntryItem) bool) {
+	if t.root != nil {
+		t.root.ascend(start, end, fn)
+	}
+}
+
+func (t *btreeIndex) Descend(start, end Key, fn func(key Key, item EntryItem) bool) {
+	if t.root != nil {
+		t.root.descend(start, end, fn)
+	}
+}
+
+func (t *btreeIndex) Clone() index {
+	c := &btreeIndex{length: t.length}
+	if t.root != nil {
+		c.root = t.root.clone()
+	}
+	return c
+}
+
+func (n *btreeNode) leaf() bool {
+	return len(n.children) == 0
+}
+
+// find returns the position of the first item not less than key, and whether
+// that item is key
+func (n *btreeNode) find(key Key) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return n.items[i].key >= key
+	})
+	return i, i < len(n.items) && n.items[i].key == key
+}
+
+// splitChild splits the full child i around its median, which moves up into n
+func (n *btreeNode) splitChild(i int) {
+	child := n.children[i]
+	median := child.items[BTREE_DEGREE-1]
+	right := &btreeNode{
+		items: append([]btreeItem(nil), child.items[BTREE_DEGREE:]...),
+	}
+	for j := BTREE_DEGREE - 1; j < len(child.items); j++ {
+		child.items[j] = btreeItem{}
+	}
+	child.items = child.items[:BTREE_DEGREE-1]
+	if !child.leaf() {
+		right.children = append([]*btreeNode(nil), child.children[BTREE_DEGREE:]...)
+		for j := BTREE_DEGREE; j < len(child.children); j++ {
+			child.children[j] = nil
+		}
+		child.children = child.children[:BTREE_DEGREE]
+	}
+	n.insertItemAt(i, median)
+	n.insertChildAt(i+1, right)
+}
+
+// insert adds or replaces key in the subtree of n, which must not be full. It
+// reports whether key is new.
+func (n *btreeNode) insert(key Key, item EntryItem) bool {
+	i, found := n.find(key)
+	if found {
+		n.items[i].item = item
+		return false
+	}
+	if n.leaf() {
+		n.insertItemAt(i, btreeItem{key, item})
+		return true
+	}
+	if len(n.children[i].items) == btreeMaxItems {
+		n.splitChild(i)
+		switch {
+		case key == n.items[i].key:
+			n.items[i].item = item
+			return false
+		case key > n.items[i].key:
+			i++
+		}
+	}
+	return n.children[i].insert(key, item)
+}
+
+// remove deletes key from the subtree of n and reports whether it was there.
+// Unless n is the root it must hold at least BTREE_DEGREE items, so that a
+// removal never leaves it underfull.
+func (n *btreeNode) remove(key Key) bool {
+	i, found := n.find(key)
+	if n.leaf() {
+		if found {
+			n.removeItemAt(i)
+		}
+		return found
+	}
+	if found {
+		left, right := n.children[i], n.children[i+1]
+		switch {
+		case len(left.items) >= BTREE_DEGREE:
+			pred := left.max()
+			n.items[i] = pred
+			return left.remove(pred.key)
+		case len(right.items) >= BTREE_DEGREE:
+			succ := right.min()
+			n.items[i] = succ
+			return right.remove(succ.key)
+		default:
+			n.mergeChildren(i)
+			return left.remove(key)
+		}
+	}
+	if len(n.children[i].items) < BTREE_DEGREE {
+		i = n.fill(i)
+	}
+	return n.children[i].remove(key)
+}
+
+// fill grows the underfull child i by borrowing from a sibling or merging with
+// one, it returns the new position of the child
+func (n *btreeNode) fill(i int) int {
+	child := n.children[i]
+	if i > 0 && len(n.children[i-1].items) >= BTREE_DEGREE {
+		left := n.children[i-1]
+		last := len(left.items) - 1
+		child.insertItemAt(0, n.items[i-1])
+		n.items[i-1] = left.items[last]
+		left.removeItemAt(last)
+		if !left.leaf() {
+			lastChild := len(left.children) - 1
+			child.insertChildAt(0, left.children[lastChild])
+			left.removeChildAt(lastChild)
+		}
+		return i
+	}
+	if i < len(n.children)-1 && len(n.children[i+1].items) >= BTREE_DEGREE {
+		right := n.children[i+1]
+		child.items = append(child.items, n.items[i])
+		n.items[i] = right.items[0]
+		right.removeItemAt(0)
+		if !right.leaf() {
+			child.children = append(child.children, right.children[0])
+			right.removeChildAt(0)
+		}
+		return i
+	}
+	if i < len(n.children)-1 {
+		n.mergeChildren(i)
+		return i
+	}
+	n.mergeChildren(i - 1)
+	return i - 1
+}
+
+// mergeChildren folds item i and child i+1 into child i
+func (n *btreeNode) mergeChildren(i int) {
+	left, right := n.children[i], n.children[i+1]
+	left.items = append(left.items, n.items[i])
+	left.items = append(left.items, right.items...)
+	left.children = append(left.children, right.children...)
+	n.removeItemAt(i)
+	n.removeChildAt(i + 1)
+}
+
+func (n *btreeNode) min() btreeItem {
+	for !n.leaf() {
+		n = n.children[0]
+	}
+	return n.items[0]
+}
+
+func (n *btreeNode) max() btreeItem {
+	for !n.leaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.items[len(n.items)-1]
+}
+
+func (n *btreeNode) ascend(start, end Key, fn func(key Key, item EntryItem) bool) bool {
+	i := 0
+	if start != "" {
+		i, _ = n.find(start)
+	}
+	for ; i < len(n.items); i++ {
+		if !n.leaf() && !n.children[i].ascend(start, end, fn) {
+			return false
+		}
+		it := n.items[i]
+		if end != "" && it.key >= end {
+			return false
+		}
+		if !fn(it.key, it.item) {
+			return false
+		}
+	}
+	if !n.leaf() {
+		return n.children[len(n.items)].ascend(start, end, fn)
+	}
+	return true
+}
+
+func (n *btreeNode) descend(start, end Key, fn func(key Key, item EntryItem) bool) bool {
+	i := len(n.items)
+	if end != "" {
+		i, _ = n.find(end)
+	}
+	if !n.leaf() && !n.children[i].descend(start, end, fn) {
+		return false
+	}
+	for i--; i >= 0; i-- {
+		it := n.items[i]
+		if it.key < start {
+			return false
+		}
+		if !fn(it.key, it.item) {
+			return false
+		}
+		if !n.leaf() && !n.children[i].descend(start, end, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *btreeNode) clone() *btreeNode {
+	c := &btreeNode{items: append([]btreeItem(nil), n.items...)}
+	if !n.leaf() {
+		c.children = make([]*btreeNode, len(n.children))
+		for i, child := range n.children {
+			c.children[i] = child.clone()
+		}
+	}
+	return c
+}
+
+func (n *btreeNode) insertItemAt(i int, it btreeItem) {
+	n.items = append(n.items, btreeItem{})
+	copy(n.items[i+1:], n.items[i:])
+	n.items[i] = it
+}
+
+func (n *btreeNode) removeItemAt(i int) {
+	copy(n.items[i:], n.items[i+1:])
+	n.items[len(n.items)-1] = btreeItem{}
+	n.items = n.items[:len(n.items)-1]
+}
+
+func (n *btreeNode) insertChildAt(i int, child *btreeNode) {
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+}
+
+func (n *btreeNode) removeChildAt(i int) {
+	copy(n.children[i:], n.children[i+1:])
+	n.children[len(n.children)-1] = nil
+	n.children = n.children[:len(n.children)-1]
+}
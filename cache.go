@@ -0,0 +1,131 @@
+package memorylanedb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// valueCache is an LRU cache of values bounded by the bytes of their keys and
+// values. Every value is stored with the keyDir entry it was read from and
+// only served for that entry, so a value replaced after it was cached is never
+// returned. It is safe for concurrent use.
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	entries  map[Key]*list.Element
+	lru      *list.List // most recently used first
+	hits     uint64
+	misses   uint64
+}
+
+type cachedValue struct {
+	key   Key
+	item  EntryItem
+	value []byte
+}
+
+func (cv *cachedValue) size() int64 {
+	return int64(len(cv.key) + len(cv.value))
+}
+
+func newValueCache(capacity int64) *valueCache {
+	return &valueCache{
+		capacity: capacity,
+		entries:  make(map[Key]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns a copy of the value cached for key if it was read from item
+func (c *valueCache) get(key Key, item EntryItem) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.Value.(*cachedValue).item != item {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return append([]byte(nil), e.Value.(*cachedValue).value...), true
+}
+
+// add caches a copy of the value of key read from item, evicting the least
+// recently used values to make room
+func (c *valueCache) add(key Key, item EntryItem, value []byte) {
+	cv := &cachedValue{key: key, item: item, value: append([]byte(nil), value...)}
+	if cv.size() > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+	c.entries[key] = c.lru.PushFront(cv)
+	c.size += cv.size()
+	for c.size > c.capacity {
+		c.remove(c.lru.Back().Value.(*cachedValue).key)
+	}
+}
+
+func (c *valueCache) invalidate(key Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+}
+
+// remove drops key from the cache; callers must hold c.mu
+func (c *valueCache) remove(key Key) {
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(e)
+	delete(c.entries, key)
+	c.size -= e.Value.(*cachedValue).size()
+}
+
+func (c *valueCache) stats() (hits, misses uint64, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.size
+}
+
+// readCached reads and verifies the value of key from its entry at item, in
+// the datafile found by lookup, serving it from the value cache when possible
+func (db *DB) readCached(key Key, item EntryItem, lookup func(id int) (Datafile, bool)) ([]byte, error) {
+	if db.cache != nil {
+		if value, ok := db.cache.get(key, item); ok {
+			return value, nil
+		}
+	}
+	df, ok := lookup(int(item.fileId))
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	entry, _, err := df.ReadFrom(item.entryOffset, item.entrySize)
+	if err != nil {
+		return nil, err
+	}
+	if entry.IsBlobPointer() {
+		if entry, err = readBlob(entry, lookup); err != nil {
+			return nil, err
+		}
+	}
+	value, err := db.decompressValue(&entry)
+	if err != nil {
+		return nil, err
+	}
+	if db.cache != nil {
+		db.cache.add(key, item, value)
+	}
+	return value, nil
+}
+
+// invalidateValue drops the cached value of key, it is called whenever key is
+// pointed at another entry
+func (db *DB) invalidateValue(key Key) {
+	if db.cache != nil {
+		db.cache.invalidate(key)
+	}
+}
@@ -0,0 +1,118 @@
+package memorylanedb
+
+import (
+	"context"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestValueCache(t *testing.T) {
+	assert := assert2.New(t)
+
+	t.Run("Eviction", func(t *testing.T) {
+		// room for two keys with 4 byte values
+		c := newValueCache(14)
+		c.add("a", EntryItem{seq: 1}, []byte("aaaa"))
+		c.add("b", EntryItem{seq: 2}, []byte("bbbb"))
+		_, ok := c.get("a", EntryItem{seq: 1})
+		assert.True(ok)
+		// b is the least recently used now
+		c.add("c", EntryItem{seq: 3}, []byte("cccc"))
+		_, ok = c.get("b", EntryItem{seq: 2})
+		assert.False(ok)
+		value, ok := c.get("a", EntryItem{seq: 1})
+		assert.True(ok)
+		assert.Equal([]byte("aaaa"), value)
+
+		// too large to ever fit
+		c.add("d", EntryItem{seq: 4}, make([]byte, 14))
+		_, ok = c.get("d", EntryItem{seq: 4})
+		assert.False(ok)
+
+		hits, misses, size := c.stats()
+		assert.Equal(uint64(2), hits)
+		assert.Equal(uint64(2), misses)
+		assert.Equal(int64(10), size)
+	})
+
+	t.Run("StaleEntry", func(t *testing.T) {
+		c := newValueCache(1024)
+		c.add("a", EntryItem{seq: 1}, []byte("old"))
+		_, ok := c.get("a", EntryItem{seq: 2})
+		assert.False(ok)
+	})
+
+	t.Run("CopiesValues", func(t *testing.T) {
+		c := newValueCache(1024)
+		value := []byte("value")
+		c.add("a", EntryItem{}, value)
+		value[0] = 'X'
+		got, _ := c.get("a", EntryItem{})
+		got[1] = 'X'
+		got, _ = c.get("a", EntryItem{})
+		assert.Equal([]byte("value"), got)
+	})
+}
+
+func TestCachedDB(t *testing.T) {
+	assert := assert2.New(t)
+	db, err := NewDB(t.TempDir(), &Option{CacheSize: 1 << 20})
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+
+	get := func(key Key, expected string) {
+		value, err := db.Get(key)
+		assert.NoError(err)
+		assert.Equal([]byte(expected), value)
+	}
+	counters := func() (uint64, uint64) {
+		stats := db.Stats()
+		return stats["cacheHits"].(uint64), stats["cacheMisses"].(uint64)
+	}
+
+	assert.NoError(db.Put("foo", []byte("bar")))
+	get("foo", "bar")
+	get("foo", "bar")
+	hits, misses := counters()
+	assert.Equal(uint64(1), hits)
+	assert.Equal(uint64(1), misses)
+
+	t.Run("InvalidatedByPut", func(t *testing.T) {
+		assert.NoError(db.Put("foo", []byte("baz")))
+		get("foo", "baz")
+		_, misses := counters()
+		assert.Equal(uint64(2), misses)
+	})
+
+	t.Run("InvalidatedByDelete", func(t *testing.T) {
+		assert.NoError(db.Delete("foo"))
+		_, err := db.Get("foo")
+		assert.ErrorIs(err, ErrKeyNotFound)
+		_, _, size := db.cache.stats()
+		assert.Equal(int64(0), size)
+	})
+
+	t.Run("InvalidatedByMerge", func(t *testing.T) {
+		assert.NoError(db.Put("foo", []byte("qux")))
+		get("foo", "qux")
+		assert.NoError(db.Merge(context.Background()))
+		_, _, size := db.cache.stats()
+		assert.Equal(int64(0), size)
+		get("foo", "qux")
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		db, err := NewDB(t.TempDir(), nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		assert.Nil(db.cache)
+		assert.NotContains(db.Stats(), "cacheHits")
+		_, err = NewDB(t.TempDir(), &Option{CacheSize: -1})
+		assert.ErrorIs(err, ErrInvalidOption)
+	})
+}
@@ -34,6 +34,8 @@ The commands are:
 	put       	insert a key-value pair in the db
 	get       	retrieve value of a key
 	list     	list all keys in the db
+	merge     	compact the datafiles, reclaiming overwritten and deleted space
+	migrate   	rewrite a database in an older format into the current one
 	info       	print basic info
 	help        print this screen
 	stats       generate usage stats
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	mdb "github.com/sarkk0x0/memorylanedb"
+)
+
+type MergeCommand struct {
+	fs     *flag.FlagSet
+	dbPath string
+	opts   mdb.Option
+}
+
+func NewMergeCommand() *MergeCommand {
+	mc := &MergeCommand{
+		fs: flag.NewFlagSet("merge", flag.ContinueOnError),
+	}
+	mc.fs.StringVar(&mc.dbPath, "dbpath", defaultHomeDir, "path to the database directory")
+	optionFlags(mc.fs, &mc.opts)
+	return mc
+}
+
+func (mc *MergeCommand) Name() string {
+	return mc.fs.Name()
+}
+
+func (mc *MergeCommand) Init(args []string) error {
+	return mc.fs.Parse(args)
+}
+
+func (mc *MergeCommand) Run() error {
+	db, err := mdb.NewDB(mc.dbPath, &mc.opts)
+	if err != nil {
+		return err
+	}
+	if err := db.Merge(context.Background()); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	mdb "github.com/sarkk0x0/memorylanedb"
+)
+
+type MigrateCommand struct {
+	fs     *flag.FlagSet
+	dbPath string
+	opts   mdb.Option
+}
+
+func NewMigrateCommand() *MigrateCommand {
+	mc := &MigrateCommand{
+		fs: flag.NewFlagSet("migrate", flag.ContinueOnError),
+	}
+	mc.fs.StringVar(&mc.dbPath, "dbpath", defaultHomeDir, "path to the database directory")
+	optionFlags(mc.fs, &mc.opts)
+	return mc
+}
+
+func (mc *MigrateCommand) Name() string {
+	return mc.fs.Name()
+}
+
+func (mc *MigrateCommand) Init(args []string) error {
+	return mc.fs.Parse(args)
+}
+
+func (mc *MigrateCommand) Run() error {
+	migrated, err := mdb.Migrate(context.Background(), mc.dbPath, &mc.opts)
+	if err != nil {
+		return err
+	}
+	if migrated == 0 {
+		fmt.Println("Already in the current format")
+	} else {
+		fmt.Printf("Migrated %d datafiles and hintfiles to format version %d\n", migrated, mdb.CURRENT_FORMAT_VERSION)
+	}
+	return nil
+}
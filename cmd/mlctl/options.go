@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	mdb "github.com/sarkk0x0/memorylanedb"
+)
+
+// optionFlags defines the flags that set the options the database is opened
+// with on fs
+func optionFlags(fs *flag.FlagSet, opts *mdb.Option) {
+	fs.IntVar(&opts.MaxKeySize, "maxkeysize", 0, "largest key in bytes, 0 for the default")
+	fs.Func("maxvaluesize", "largest value in bytes, 0 for the default", func(s string) error {
+		size, err := strconv.ParseUint(s, 10, 32)
+		opts.MaxValueSize = uint32(size)
+		return err
+	})
+	fs.Int64Var(&opts.MaxDatafileSize, "maxdatafilesize", 0, "size at which datafiles are rotated, 0 for the default")
+	fs.Int64Var(&opts.MaxMergefileSize, "maxmergefilesize", 0, "size at which merged datafiles are rotated, 0 for the default")
+	fs.Func("encryptionkey", "encryption key as id:hexkey, can be repeated", func(s string) error {
+		id, key, ok := strings.Cut(s, ":")
+		if !ok {
+			return fmt.Errorf("%q is not id:hexkey", s)
+		}
+		keyID, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return err
+		}
+		secret, err := hex.DecodeString(key)
+		if err != nil {
+			return err
+		}
+		if opts.EncryptionKeys == nil {
+			opts.EncryptionKeys = make(map[uint32][]byte)
+		}
+		opts.EncryptionKeys[uint32(keyID)] = secret
+		return nil
+	})
+	fs.BoolVar(&opts.EncryptKeys, "encryptkeys", false, "encrypt the keys of entries as well as their values")
+}
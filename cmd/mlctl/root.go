@@ -22,6 +22,8 @@ func root(args []string) error {
 		NewGetCommand(),
 		NewPutCommand(),
 		NewListCommand(),
+		NewMergeCommand(),
+		NewMigrateCommand(),
 		NewHelpCommand(),
 	}
 
@@ -2,34 +2,284 @@ package memorylanedb
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 )
 
 var byteOrder = binary.LittleEndian
 
+const (
+	// FORMAT_V0 is the original headerless format, where a tombstone is an
+	// entry whose value is TOMBSTONE_VALUE
+	FORMAT_V0 uint16 = iota
+	// FORMAT_V1 adds a file header and a flags byte to every entry
+	FORMAT_V1
+	// FORMAT_V2 adds an expiry to entries and hints
+	FORMAT_V2
+	// FORMAT_V3 extends the entry checksum from the value to the whole entry
+	FORMAT_V3
+	// FORMAT_V4 adds a checksum to every hint and a footer to hintfiles
+	FORMAT_V4
+	// FORMAT_V5 widens the entry offset in hints to 64 bits
+	FORMAT_V5
+	// FORMAT_V6 adds the encryption key id and header flags to file headers
+	FORMAT_V6
+
+	CURRENT_FORMAT_VERSION = FORMAT_V6
+)
+
+const (
+	// In bytes
+	MAGIC_SIZE       = 4
+	VERSION_SIZE     = 2
+	FILE_HEADER_SIZE = MAGIC_SIZE + VERSION_SIZE + KEY_ID_SIZE + KEY_CHECK_SIZE + HEADER_FLAGS_SIZE
+	HINT_COUNT_SIZE  = 4
+	HINT_FOOTER_SIZE = HINT_COUNT_SIZE + MAGIC_SIZE
+)
+
+var (
+	datafileMagic = []byte("MLDF")
+	hintfileMagic = []byte("MLHF")
+	// ends a complete hintfile, after the number of hints in it
+	hintfileFooterMagic = []byte("MLHE")
+)
+
+// format describes the on-disk layout of a format version
+type format struct {
+	fileHeader     bool // files start with a magic and the version
+	entryFlags     bool // entries carry a flags byte
+	tombstoneValue bool // deletions are entries with TOMBSTONE_VALUE
+	expiry         bool // entries and hints carry an expiry
+	fullChecksum   bool // the checksum covers the header and key, not only the value
+	hintChecksum   bool // hints carry a checksum and hintfiles end with a footer
+	wideOffsets    bool // hints carry 64-bit entry offsets
+	keyID          bool // file headers carry the encryption key id, its check value and flags
+}
+
+// formats is the registry of every version the codec can decode, only
+// CURRENT_FORMAT_VERSION is ever written
+var formats = map[uint16]format{
+	FORMAT_V0: {tombstoneValue: true},
+	FORMAT_V1: {fileHeader: true, entryFlags: true},
+	FORMAT_V2: {fileHeader: true, entryFlags: true, expiry: true},
+	FORMAT_V3: {fileHeader: true, entryFlags: true, expiry: true, fullChecksum: true},
+	FORMAT_V4: {fileHeader: true, entryFlags: true, expiry: true, fullChecksum: true, hintChecksum: true},
+	FORMAT_V5: {fileHeader: true, entryFlags: true, expiry: true, fullChecksum: true, hintChecksum: true, wideOffsets: true},
+	FORMAT_V6: {fileHeader: true, entryFlags: true, expiry: true, fullChecksum: true, hintChecksum: true, wideOffsets: true, keyID: true},
+}
+
+// MAX_PREALLOC_SIZE bounds the buffer allocated upfront for a decoded value,
+// larger values grow their buffer as the bytes arrive so that a corrupted size
+// field cannot trigger a huge allocation
+const MAX_PREALLOC_SIZE = 1024 * 64
+
+func lookupFormat(version uint16) (format, error) {
+	f, ok := formats[version]
+	if !ok {
+		return format{}, ErrUnsupportedVersion
+	}
+	return f, nil
+}
+
+func (f format) fileHeaderSize() int64 {
+	if !f.fileHeader {
+		return 0
+	}
+	size := int64(MAGIC_SIZE + VERSION_SIZE)
+	if f.keyID {
+		size += KEY_ID_SIZE + KEY_CHECK_SIZE + HEADER_FLAGS_SIZE
+	}
+	return size
+}
+
+func (f format) entryHeaderSize() int64 {
+	size := int64(CRC_SIZE + TSSTAMP_SIZE + KEY_SIZE + VALUE_SIZE)
+	if f.entryFlags {
+		size += FLAGS_SIZE
+	}
+	if f.expiry {
+		size += EXPIRY_SIZE
+	}
+	return size
+}
+
+func (f format) hintHeaderSize() int64 {
+	size := int64(TSSTAMP_SIZE+KEY_SIZE+VALUE_SIZE) + f.valueOffsetSize()
+	if f.expiry {
+		size += EXPIRY_SIZE
+	}
+	if f.hintChecksum {
+		size += CRC_SIZE
+	}
+	return size
+}
+
+func (f format) valueOffsetSize() int64 {
+	if f.wideOffsets {
+		return WIDE_VALUE_OFFSET_SIZE
+	}
+	return VALUE_OFFSET_SIZE
+}
+
 type Codec struct {
-	w *bufio.Writer
-	r io.Reader
+	w       *bufio.Writer
+	r       *bufio.Reader
+	version uint16
+	format  format
+	keys    *keyring // opens the file header, nil without encryption
+	sealing *sealing // nil unless the entries are encrypted
 }
 
 func NewCodec(f io.ReadWriter) *Codec {
 	return &Codec{
-		w: bufio.NewWriter(f),
-		r: bufio.NewReader(f),
+		w:       bufio.NewWriter(f),
+		r:       bufio.NewReader(f),
+		version: CURRENT_FORMAT_VERSION,
+		format:  formats[CURRENT_FORMAT_VERSION],
+	}
+}
+
+// NewReaderCodec returns a decode-only codec. It is used to scan a file
+// independently of the codec owned by its datafile.
+func NewReaderCodec(r io.Reader, version uint16) *Codec {
+	return &Codec{
+		r:       bufio.NewReader(r),
+		version: version,
+		format:  formats[version],
 	}
 }
 
+func (c *Codec) Version() uint16 {
+	return c.version
+}
+
+// EncodeHeader writes a file header with the given magic for the current
+// format version, recording the newest key of the codec keyring that the
+// entries of the file are sealed with
+func (c *Codec) EncodeHeader(magic []byte) (int64, error) {
+	s := c.keys.sealing()
+	if _, err := c.w.Write(fileHeader(magic, s)); err != nil {
+		return 0, ErrWritingHeader
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+	c.version = CURRENT_FORMAT_VERSION
+	c.format = formats[CURRENT_FORMAT_VERSION]
+	c.sealing = s
+	return FILE_HEADER_SIZE, nil
+}
+
+// DecodeHeader reads the file header, expecting the given magic, and switches
+// the codec to its format version and encryption key. Files without a header
+// are FORMAT_V0 and nothing is consumed; a header of another file kind is
+// rejected.
+func (c *Codec) DecodeHeader(magic []byte) (int64, error) {
+	buf, err := c.r.Peek(MAGIC_SIZE + VERSION_SIZE)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if err == io.EOF || !bytes.Equal(buf[:MAGIC_SIZE], magic) {
+		if err == nil && isKnownMagic(buf[:MAGIC_SIZE]) {
+			return 0, ErrInvalidFileHeader
+		}
+		c.version = FORMAT_V0
+		c.format = formats[FORMAT_V0]
+		return 0, nil
+	}
+	version := byteOrder.Uint16(buf[MAGIC_SIZE:])
+	f, err := lookupFormat(version)
+	if err != nil {
+		return 0, err
+	}
+	headerSize := f.fileHeaderSize()
+	if buf, err = c.r.Peek(int(headerSize)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	var s *sealing
+	if f.keyID {
+		ptr := MAGIC_SIZE + VERSION_SIZE
+		keyID := byteOrder.Uint32(buf[ptr:])
+		ptr += KEY_ID_SIZE
+		check := buf[ptr : ptr+KEY_CHECK_SIZE]
+		if s, err = c.keys.open(keyID, check, buf[headerSize-HEADER_FLAGS_SIZE]); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := c.r.Discard(int(headerSize)); err != nil {
+		return 0, err
+	}
+	c.version = version
+	c.format = f
+	c.sealing = s
+	return headerSize, nil
+}
+
+// KeyID is the id of the key the entries are encrypted with, 0 if they are
+// not
+func (c *Codec) KeyID() uint32 {
+	if c.sealing == nil {
+		return 0
+	}
+	return c.sealing.keyID
+}
+
+// fileHeader returns the header a file of the given magic and sealing starts
+// with
+func fileHeader(magic []byte, s *sealing) []byte {
+	buf := make([]byte, FILE_HEADER_SIZE)
+	copy(buf[:MAGIC_SIZE], magic)
+	byteOrder.PutUint16(buf[MAGIC_SIZE:], CURRENT_FORMAT_VERSION)
+	if s != nil {
+		ptr := MAGIC_SIZE + VERSION_SIZE
+		byteOrder.PutUint32(buf[ptr:], s.keyID)
+		ptr += KEY_ID_SIZE
+		copy(buf[ptr:ptr+KEY_CHECK_SIZE], s.check)
+		buf[FILE_HEADER_SIZE-HEADER_FLAGS_SIZE] = s.headerFlags()
+	}
+	return buf
+}
+
+func isKnownMagic(magic []byte) bool {
+	return bytes.Equal(magic, datafileMagic) || bytes.Equal(magic, hintfileMagic)
+}
+
+func (c *Codec) entryHeaderSize() int64 {
+	return c.format.entryHeaderSize()
+}
+
+// entryHeaderSize is the size of an entry prefix in a format version
+func entryHeaderSize(version uint16) int64 {
+	return formats[version].entryHeaderSize()
+}
+
 func (c *Codec) EncodeEntry(entry *Entry) (int64, error) {
 	if entry == nil {
 		return 0, ErrorNilEncoding
 	}
-	prefixSize := entry.HeaderSize()
-	prefixBuffer := make([]byte, prefixSize)
+	if c.version != CURRENT_FORMAT_VERSION {
+		return 0, ErrUnsupportedVersion
+	}
+	if c.sealing != nil {
+		stored := c.sealing.sealEntry(entry)
+		n, err := c.encodeEntry(&stored)
+		entry.Checksum = stored.Checksum
+		return n, err
+	}
+	return c.encodeEntry(entry)
+}
+
+// encodeEntry writes entry as it is stored
+func (c *Codec) encodeEntry(entry *Entry) (int64, error) {
+	// the checksum goes in last, once the rest of the prefix is known
+	prefixBuffer := encodeEntryPrefix(entry)
+	entry.Checksum = c.checksum(prefixBuffer, entry.Key, entry.Value)
 	byteOrder.PutUint32(prefixBuffer[:CRC_SIZE], entry.Checksum)
-	byteOrder.PutUint32(prefixBuffer[CRC_SIZE:CRC_SIZE+TSSTAMP_SIZE], entry.Tstamp)
-	byteOrder.PutUint16(prefixBuffer[CRC_SIZE+TSSTAMP_SIZE:CRC_SIZE+TSSTAMP_SIZE+KEY_SIZE], entry.KeySize)
-	byteOrder.PutUint32(prefixBuffer[CRC_SIZE+TSSTAMP_SIZE+KEY_SIZE:], entry.ValueSize)
 
 	_, err := c.w.Write(prefixBuffer)
 	if err != nil {
@@ -52,30 +302,137 @@ func (c *Codec) EncodeEntry(entry *Entry) (int64, error) {
 	return entry.Size(), nil
 }
 
-func (c *Codec) DecodeEntry(entry *Entry) (int64, error) {
+// EncodeEntryFrom writes an entry whose value of entry.ValueSize bytes is
+// copied from value instead of entry.Value. The checksum field is left zero
+// since it is only known once the value went through, the caller writes
+// entry.Checksum into the first CRC_SIZE bytes of the entry afterwards. A
+// sealing codec has to read the whole value before it can encrypt it.
+func (c *Codec) EncodeEntryFrom(entry *Entry, value io.Reader) (int64, error) {
 	if entry == nil {
-		return 0, ErrorNilDecoding
+		return 0, ErrorNilEncoding
 	}
-	prefixSize := entry.HeaderSize()
-	prefixBuffer := make([]byte, prefixSize)
-
-	_, err := io.ReadFull(c.r, prefixBuffer)
-	if err != nil {
+	if c.version != CURRENT_FORMAT_VERSION {
+		return 0, ErrUnsupportedVersion
+	}
+	if c.sealing != nil {
+		buf, err := readBytes(value, int64(entry.ValueSize))
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		entry.Value = buf
+		return c.EncodeEntry(entry)
+	}
+	prefixBuffer := encodeEntryPrefix(entry)
+	if _, err := c.w.Write(prefixBuffer); err != nil {
+		return 0, ErrWritingPrefix
+	}
+	if _, err := c.w.Write(entry.Key); err != nil {
+		return 0, ErrWritingKey
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(prefixBuffer[CRC_SIZE:])
+	crc.Write(entry.Key)
+	if _, err := io.CopyN(io.MultiWriter(c.w, crc), value, int64(entry.ValueSize)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return 0, err
 	}
-	var ptr uint32 = 0
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+	entry.Checksum = crc.Sum32()
+	return entry.HeaderSize() + int64(entry.KeySize) + int64(entry.ValueSize), nil
+}
 
-	entry.Checksum = byteOrder.Uint32(prefixBuffer[ptr : ptr+CRC_SIZE])
+// encodeEntryPrefix encodes the fixed size fields of entry in the current
+// format, except for the checksum
+func encodeEntryPrefix(entry *Entry) []byte {
+	prefixBuffer := make([]byte, entry.HeaderSize())
+	var ptr int64 = CRC_SIZE
+	byteOrder.PutUint32(prefixBuffer[ptr:ptr+TSSTAMP_SIZE], entry.Tstamp)
+	ptr += TSSTAMP_SIZE
+	byteOrder.PutUint32(prefixBuffer[ptr:ptr+EXPIRY_SIZE], entry.Expiry)
+	ptr += EXPIRY_SIZE
+	prefixBuffer[ptr] = entry.Flags
+	ptr += FLAGS_SIZE
+	byteOrder.PutUint16(prefixBuffer[ptr:ptr+KEY_SIZE], entry.KeySize)
+	ptr += KEY_SIZE
+	byteOrder.PutUint32(prefixBuffer[ptr:ptr+VALUE_SIZE], entry.ValueSize)
+	return prefixBuffer
+}
+
+// checksum computes the checksum of an entry from its encoded prefix, older
+// formats only covered the value
+func (c *Codec) checksum(prefix, key, value []byte) uint32 {
+	return crc32.Update(c.checksumStart(prefix, key), crc32.IEEETable, value)
+}
+
+// checksumStart is the checksum of an entry before its value is added
+func (c *Codec) checksumStart(prefix, key []byte) uint32 {
+	if !c.format.fullChecksum {
+		return 0
+	}
+	crc := crc32.ChecksumIEEE(prefix[CRC_SIZE:])
+	return crc32.Update(crc, crc32.IEEETable, key)
+}
+
+// decodeEntryPrefix fills the fixed size fields of entry from buf
+func (c *Codec) decodeEntryPrefix(buf []byte, entry *Entry) error {
+	var ptr int64 = 0
+
+	entry.Checksum = byteOrder.Uint32(buf[ptr : ptr+CRC_SIZE])
 	ptr += CRC_SIZE
 
-	entry.Tstamp = byteOrder.Uint32(prefixBuffer[ptr : ptr+TSSTAMP_SIZE])
+	entry.Tstamp = byteOrder.Uint32(buf[ptr : ptr+TSSTAMP_SIZE])
 	ptr += TSSTAMP_SIZE
 
-	entry.KeySize = byteOrder.Uint16(prefixBuffer[ptr : ptr+KEY_SIZE])
+	entry.Expiry = 0
+	if c.format.expiry {
+		entry.Expiry = byteOrder.Uint32(buf[ptr : ptr+EXPIRY_SIZE])
+		ptr += EXPIRY_SIZE
+	}
+
+	entry.Flags = 0
+	if c.format.entryFlags {
+		entry.Flags = buf[ptr]
+		ptr += FLAGS_SIZE
+		if entry.Flags&^KNOWN_FLAGS != 0 {
+			return ErrUnknownEntryFlags
+		}
+	}
+
+	entry.KeySize = byteOrder.Uint16(buf[ptr : ptr+KEY_SIZE])
 	ptr += KEY_SIZE
 
-	entry.ValueSize = byteOrder.Uint32(prefixBuffer[ptr : ptr+VALUE_SIZE])
-	ptr += VALUE_SIZE
+	entry.ValueSize = byteOrder.Uint32(buf[ptr : ptr+VALUE_SIZE])
+	return nil
+}
+
+// decodeLegacyFlags derives the flags that older formats encoded in the value
+func (c *Codec) decodeLegacyFlags(entry *Entry) {
+	if c.format.tombstoneValue && bytes.Equal(entry.Value, []byte(TOMBSTONE_VALUE)) {
+		entry.Flags |= FLAG_TOMBSTONE
+	}
+}
+
+func (c *Codec) DecodeEntry(entry *Entry) (int64, error) {
+	if entry == nil {
+		return 0, ErrorNilDecoding
+	}
+	prefixSize := c.entryHeaderSize()
+	prefixBuffer := make([]byte, prefixSize)
+
+	_, err := io.ReadFull(c.r, prefixBuffer)
+	if err != nil {
+		return 0, err
+	}
+	if err = c.decodeEntryPrefix(prefixBuffer, entry); err != nil {
+		return 0, err
+	}
 
 	keyBuf := make([]byte, entry.KeySize)
 	_, err = io.ReadFull(c.r, keyBuf)
@@ -84,51 +441,107 @@ func (c *Codec) DecodeEntry(entry *Entry) (int64, error) {
 	}
 	entry.Key = keyBuf
 
-	valueBuf := make([]byte, entry.ValueSize)
-	_, err = io.ReadFull(c.r, valueBuf)
+	valueBuf, err := readBytes(c.r, int64(entry.ValueSize))
 	if err != nil {
 		return 0, err
 	}
 	entry.Value = valueBuf
+	if entry.Checksum != c.checksum(prefixBuffer, entry.Key, entry.Value) {
+		return 0, ErrCorruptedData
+	}
+	c.decodeLegacyFlags(entry)
 
-	return entry.Size(), nil
+	return c.openEntry(entry, prefixSize+int64(entry.KeySize)+int64(entry.ValueSize))
 }
 
 func (c *Codec) DecodeSingleEntry(buf []byte, entry *Entry) (int64, error) {
 	if entry == nil {
 		return 0, ErrorNilDecoding
 	}
-	var ptr uint32 = 0
-	entry.Checksum = byteOrder.Uint32(buf[ptr : ptr+CRC_SIZE])
-	ptr += CRC_SIZE
-
-	entry.Tstamp = byteOrder.Uint32(buf[ptr : ptr+TSSTAMP_SIZE])
-	ptr += TSSTAMP_SIZE
-
-	entry.KeySize = byteOrder.Uint16(buf[ptr : ptr+KEY_SIZE])
-	ptr += KEY_SIZE
-
-	entry.ValueSize = byteOrder.Uint32(buf[ptr : ptr+VALUE_SIZE])
-	ptr += VALUE_SIZE
+	prefixSize := c.entryHeaderSize()
+	if int64(len(buf)) < prefixSize {
+		return 0, ErrCorruptedData
+	}
+	if err := c.decodeEntryPrefix(buf, entry); err != nil {
+		return 0, err
+	}
+	if int64(len(buf)) != prefixSize+int64(entry.KeySize)+int64(entry.ValueSize) {
+		return 0, ErrCorruptedData
+	}
 
-	bufWithoutPrefix := buf[ptr:]
+	bufWithoutPrefix := buf[prefixSize:]
 
 	entry.Key = bufWithoutPrefix[:entry.KeySize]
 	entry.Value = bufWithoutPrefix[entry.KeySize:]
+	if entry.Checksum != c.checksum(buf[:prefixSize], entry.Key, entry.Value) {
+		return 0, ErrCorruptedData
+	}
+	c.decodeLegacyFlags(entry)
 
-	return entry.Size(), nil
+	return c.openEntry(entry, prefixSize+int64(entry.KeySize)+int64(entry.ValueSize))
+}
+
+// openEntry decrypts a decoded entry that took size bytes, if the codec is
+// sealing
+func (c *Codec) openEntry(entry *Entry, size int64) (int64, error) {
+	if c.sealing != nil {
+		if err := c.sealing.openEntry(entry); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// readBytes reads n bytes from r. Up to MAX_PREALLOC_SIZE the buffer is
+// allocated upfront, beyond that it grows with the bytes actually read.
+func readBytes(r io.Reader, n int64) ([]byte, error) {
+	if n <= MAX_PREALLOC_SIZE {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(MAX_PREALLOC_SIZE)
+	read, err := buf.ReadFrom(io.LimitReader(r, n))
+	if err != nil {
+		return nil, err
+	}
+	if read < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
 }
 
+// EncodeHint writes hint. A sealing codec writes the sizes the sealed entry has
+// in its datafile and encrypts the key if the file seals keys.
 func (c *Codec) EncodeHint(hint *Hint) (int64, error) {
 	if hint == nil {
 		return 0, ErrorNilEncoding
 	}
+	if c.version != CURRENT_FORMAT_VERSION {
+		return 0, ErrUnsupportedVersion
+	}
+	if c.sealing != nil {
+		stored := c.sealing.sealHint(hint)
+		hint = &stored
+	}
 	prefixSize := hint.HeaderSize()
 	prefixBuffer := make([]byte, prefixSize)
-	byteOrder.PutUint32(prefixBuffer[:TSSTAMP_SIZE], hint.Tstamp)
-	byteOrder.PutUint16(prefixBuffer[TSSTAMP_SIZE:TSSTAMP_SIZE+KEY_SIZE], hint.KeySize)
-	byteOrder.PutUint32(prefixBuffer[TSSTAMP_SIZE+KEY_SIZE:TSSTAMP_SIZE+KEY_SIZE+VALUE_SIZE], hint.ValueSize)
-	byteOrder.PutUint32(prefixBuffer[prefixSize-VALUE_OFFSET_SIZE:], hint.ValueOffset)
+	// the checksum goes in last, once the rest of the prefix is known
+	var ptr int64 = CRC_SIZE
+	byteOrder.PutUint32(prefixBuffer[ptr:ptr+TSSTAMP_SIZE], hint.Tstamp)
+	ptr += TSSTAMP_SIZE
+	byteOrder.PutUint32(prefixBuffer[ptr:ptr+EXPIRY_SIZE], hint.Expiry)
+	ptr += EXPIRY_SIZE
+	byteOrder.PutUint16(prefixBuffer[ptr:ptr+KEY_SIZE], hint.KeySize)
+	ptr += KEY_SIZE
+	byteOrder.PutUint32(prefixBuffer[ptr:ptr+VALUE_SIZE], hint.ValueSize)
+	ptr += VALUE_SIZE
+	byteOrder.PutUint64(prefixBuffer[ptr:ptr+WIDE_VALUE_OFFSET_SIZE], hint.ValueOffset)
+	crc := crc32.Update(crc32.ChecksumIEEE(prefixBuffer[CRC_SIZE:]), crc32.IEEETable, hint.Key)
+	byteOrder.PutUint32(prefixBuffer[:CRC_SIZE], crc)
 
 	_, err := c.w.Write(prefixBuffer)
 	if err != nil {
@@ -149,7 +562,7 @@ func (c *Codec) DecodeHint(hint *Hint) error {
 	if hint == nil {
 		return ErrorNilDecoding
 	}
-	prefixSize := hint.HeaderSize()
+	prefixSize := c.format.hintHeaderSize()
 	prefixBuffer := make([]byte, prefixSize)
 
 	_, err := io.ReadFull(c.r, prefixBuffer)
@@ -158,17 +571,33 @@ func (c *Codec) DecodeHint(hint *Hint) error {
 	}
 	var ptr uint32 = 0
 
+	var crc uint32
+	if c.format.hintChecksum {
+		crc = byteOrder.Uint32(prefixBuffer[ptr : ptr+CRC_SIZE])
+		ptr += CRC_SIZE
+	}
+
 	hint.Tstamp = byteOrder.Uint32(prefixBuffer[ptr : ptr+TSSTAMP_SIZE])
 	ptr += TSSTAMP_SIZE
 
+	hint.Expiry = 0
+	if c.format.expiry {
+		hint.Expiry = byteOrder.Uint32(prefixBuffer[ptr : ptr+EXPIRY_SIZE])
+		ptr += EXPIRY_SIZE
+	}
+
 	hint.KeySize = byteOrder.Uint16(prefixBuffer[ptr : ptr+KEY_SIZE])
 	ptr += KEY_SIZE
 
 	hint.ValueSize = byteOrder.Uint32(prefixBuffer[ptr : ptr+VALUE_SIZE])
 	ptr += VALUE_SIZE
 
-	hint.ValueOffset = byteOrder.Uint32(prefixBuffer[ptr : ptr+VALUE_OFFSET_SIZE])
-	ptr += VALUE_OFFSET_SIZE
+	if c.format.wideOffsets {
+		hint.ValueOffset = byteOrder.Uint64(prefixBuffer[ptr : ptr+WIDE_VALUE_OFFSET_SIZE])
+	} else {
+		hint.ValueOffset = uint64(byteOrder.Uint32(prefixBuffer[ptr : ptr+VALUE_OFFSET_SIZE]))
+	}
+	ptr += uint32(c.format.valueOffsetSize())
 
 	keyBuf := make([]byte, hint.KeySize)
 	_, err = io.ReadFull(c.r, keyBuf)
@@ -177,5 +606,37 @@ func (c *Codec) DecodeHint(hint *Hint) error {
 	}
 	hint.Key = keyBuf
 
+	if c.format.hintChecksum {
+		if crc != crc32.Update(crc32.ChecksumIEEE(prefixBuffer[CRC_SIZE:]), crc32.IEEETable, keyBuf) {
+			return ErrCorruptedData
+		}
+	}
+	if c.sealing != nil {
+		return c.sealing.openHint(hint)
+	}
 	return nil
 }
+
+// EncodeHintFooter writes the footer that marks a hintfile of count hints as
+// complete
+func (c *Codec) EncodeHintFooter(count uint32) (int64, error) {
+	buf := make([]byte, HINT_FOOTER_SIZE)
+	byteOrder.PutUint32(buf, count)
+	copy(buf[HINT_COUNT_SIZE:], hintfileFooterMagic)
+	if _, err := c.w.Write(buf); err != nil {
+		return 0, ErrWritingFooter
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+	return HINT_FOOTER_SIZE, nil
+}
+
+// DecodeHintFooter parses the last HINT_FOOTER_SIZE bytes of a hintfile and
+// returns the number of hints it holds
+func (c *Codec) DecodeHintFooter(buf []byte) (uint32, error) {
+	if len(buf) != HINT_FOOTER_SIZE || !bytes.Equal(buf[HINT_COUNT_SIZE:], hintfileFooterMagic) {
+		return 0, ErrCorruptedData
+	}
+	return byteOrder.Uint32(buf), nil
+}
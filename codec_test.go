@@ -2,6 +2,7 @@ package memorylanedb
 
 import (
 	"bytes"
+	"io"
 	"math/rand"
 	"testing"
 	"time"
@@ -53,7 +54,7 @@ func TestHint(t *testing.T) {
 		Tstamp:      uint32(time.Now().Unix()),
 		KeySize:     uint16(len(key)),
 		ValueSize:   uint32(len(value)),
-		ValueOffset: uint32(rand.Int31()),
+		ValueOffset: uint64(rand.Int63()),
 		Key:         key,
 	}
 
@@ -65,7 +66,56 @@ func TestHint(t *testing.T) {
 		decodedHint := Hint{}
 		err := codec.DecodeHint(&decodedHint)
 		assert.NoError(err)
+		// offsets past 4GB survive the round trip
+		assert.Equal(hint.ValueOffset, decodedHint.ValueOffset)
 		t.Logf("%+v", decodedHint)
 	})
 
 }
+
+func TestEntryChecksum(t *testing.T) {
+	assert := assert2.New(t)
+	encode := func() []byte {
+		var buf bytes.Buffer
+		entry := NewEntry([]byte("testKey"), []byte("randomValue"))
+		_, err := NewCodec(&buf).EncodeEntry(&entry)
+		assert.NoError(err)
+		return buf.Bytes()
+	}
+	prefixSize := entryHeaderSize(CURRENT_FORMAT_VERSION)
+
+	t.Run("Valid", func(t *testing.T) {
+		var entry Entry
+		_, err := NewReaderCodec(bytes.NewReader(encode()), CURRENT_FORMAT_VERSION).DecodeEntry(&entry)
+		assert.NoError(err)
+		assert.Equal([]byte("testKey"), entry.Key)
+	})
+
+	t.Run("CorruptedKey", func(t *testing.T) {
+		buf := encode()
+		buf[prefixSize] ^= 0x01
+		var entry Entry
+		_, err := NewReaderCodec(bytes.NewReader(buf), CURRENT_FORMAT_VERSION).DecodeEntry(&entry)
+		assert.ErrorIs(err, ErrCorruptedData)
+		_, err = NewReaderCodec(nil, CURRENT_FORMAT_VERSION).DecodeSingleEntry(buf, &entry)
+		assert.ErrorIs(err, ErrCorruptedData)
+	})
+
+	t.Run("CorruptedTimestamp", func(t *testing.T) {
+		buf := encode()
+		buf[CRC_SIZE] ^= 0x01
+		var entry Entry
+		_, err := NewReaderCodec(nil, CURRENT_FORMAT_VERSION).DecodeSingleEntry(buf, &entry)
+		assert.ErrorIs(err, ErrCorruptedData)
+	})
+
+	t.Run("CorruptedValueSize", func(t *testing.T) {
+		buf := encode()
+		byteOrder.PutUint32(buf[prefixSize-VALUE_SIZE:], 0xffffffff)
+		var entry Entry
+		_, err := NewReaderCodec(bytes.NewReader(buf), CURRENT_FORMAT_VERSION).DecodeEntry(&entry)
+		assert.ErrorIs(err, io.ErrUnexpectedEOF)
+		_, err = NewReaderCodec(nil, CURRENT_FORMAT_VERSION).DecodeSingleEntry(buf, &entry)
+		assert.ErrorIs(err, ErrCorruptedData)
+	})
+}
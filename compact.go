@@ -0,0 +1,297 @@
+package memorylanedb
+
+import "math"
+
+/*
+	The compact index stores no Go pointers, so the garbage collector never
+	scans it, and needs no allocation per key:
+
+	- keys are appended to a key arena, a list of fixed size chunks, each key
+	  prefixed with its uint16 length
+	- every key has a 48 byte record holding its arena reference, its hash and
+	  the fields of its EntryItem; records live in fixed size pages and the
+	  records of deleted keys are reused
+	- an open addressing table with linear probing maps hashes to record
+	  numbers, 4 bytes per slot
+
+	Overwriting a key only rewrites its record. Deleted keys leave garbage in
+	the arena, which is compacted once it outweighs the live keys.
+*/
+
+const (
+	COMPACT_ARENA_CHUNK_SIZE = 1 << 20 // bytes per key arena chunk
+	COMPACT_PAGE_SIZE        = 1 << 12 // records per page
+	COMPACT_MIN_TABLE_BITS   = 4
+)
+
+type compactRecord struct {
+	key         uint64 // arena chunk << 32 | offset in the chunk
+	entrySize   uint64
+	entryOffset uint64
+	seq         uint64
+	hash        uint32
+	fileId      uint32
+	tstamp      uint32
+	expiry      uint32
+}
+
+type compactIndex struct {
+	table   []uint32 // record number + 1, 0 for an empty slot
+	bits    uint     // len(table) is 1 << bits
+	pages   [][]compactRecord
+	free    []uint32 // numbers of the records of deleted keys
+	length  int
+	arena   [][]byte
+	used    int // bytes appended to the arena
+	garbage int // arena bytes of deleted keys
+}
+
+func newCompactIndex() *compactIndex {
+	return &compactIndex{
+		table: make([]uint32, 1<<COMPACT_MIN_TABLE_BITS),
+		bits:  COMPACT_MIN_TABLE_BITS,
+	}
+}
+
+// hashKey hashes key with 32-bit FNV-1a
+func hashKey(key Key) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// home is the slot a hash is probed from, Fibonacci hashing spreads the
+// FNV-1a output over the top bits
+func (c *compactIndex) home(hash uint32) uint32 {
+	return (hash * 0x9e3779b1) >> (32 - c.bits)
+}
+
+func (c *compactIndex) record(n uint32) *compactRecord {
+	return &c.pages[n/COMPACT_PAGE_SIZE][n%COMPACT_PAGE_SIZE]
+}
+
+func (c *compactIndex) key(ref uint64) []byte {
+	chunk := c.arena[ref>>32]
+	offset := uint32(ref)
+	size := uint32(byteOrder.Uint16(chunk[offset:]))
+	return chunk[offset+2 : offset+2+size]
+}
+
+// find returns the slot holding key, or the empty slot it would go in
+func (c *compactIndex) find(key Key, hash uint32) (uint32, bool) {
+	mask := uint32(len(c.table) - 1)
+	for slot := c.home(hash); ; slot = (slot + 1) & mask {
+		n := c.table[slot]
+		if n == 0 {
+			return slot, false
+		}
+		r := c.record(n - 1)
+		if r.hash == hash && string(c.key(r.key)) == string(key) {
+			return slot, true
+		}
+	}
+}
+
+func (c *compactIndex) Get(key Key) (EntryItem, bool) {
+	slot, ok := c.find(key, hashKey(key))
+	if !ok {
+		return EntryItem{}, false
+	}
+	return c.record(c.table[slot] - 1).item(), true
+}
+
+func (c *compactIndex) Put(key Key, item EntryItem) {
+	hash := hashKey(key)
+	slot, ok := c.find(key, hash)
+	if ok {
+		c.record(c.table[slot] - 1).set(item)
+		return
+	}
+	if (c.length+1)*4 > len(c.table)*3 {
+		c.grow()
+		slot, _ = c.find(key, hash)
+	}
+	n := c.newRecord()
+	r := c.record(n)
+	r.key = c.appendKey(key)
+	r.hash = hash
+	r.set(item)
+	c.table[slot] = n + 1
+	c.length++
+}
+
+func (c *compactIndex) Delete(key Key) {
+	slot, ok := c.find(key, hashKey(key))
+	if !ok {
+		return
+	}
+	n := c.table[slot] - 1
+	c.garbage += 2 + len(key)
+	*c.record(n) = compactRecord{}
+	c.free = append(c.free, n)
+	c.length--
+
+	// shift the following keys back so no probe sequence has a hole
+	mask := uint32(len(c.table) - 1)
+	hole := slot
+	for next := (slot + 1) & mask; c.table[next] != 0; next = (next + 1) & mask {
+		home := c.home(c.record(c.table[next] - 1).hash)
+		// the key at next can move into the hole unless its home lies
+		// cyclically in (hole, next]
+		if (next-home)&mask >= (next-hole)&mask {
+			c.table[hole] = c.table[next]
+			hole = next
+		}
+	}
+	c.table[hole] = 0
+
+	if c.garbage > COMPACT_ARENA_CHUNK_SIZE && c.garbage > c.used-c.garbage {
+		c.compactArena()
+	}
+}
+
+func (c *compactIndex) Len() int {
+	return c.length
+}
+
+func (c *compactIndex) Range(fn func(key Key, item EntryItem) bool) {
+	for _, n := range c.table {
+		if n == 0 {
+			continue
+		}
+		r := c.record(n - 1)
+		if !fn(Key(c.key(r.key)), r.item()) {
+			return
+		}
+	}
+}
+
+func (c *compactIndex) Clone() index {
+	clone := &compactIndex{
+		table:   append([]uint32(nil), c.table...),
+		bits:    c.bits,
+		pages:   make([][]compactRecord, len(c.pages)),
+		free:    append([]uint32(nil), c.free...),
+		length:  c.length,
+		arena:   make([][]byte, len(c.arena)),
+		used:    c.used,
+		garbage: c.garbage,
+	}
+	for i, page := range c.pages {
+		clone.pages[i] = append([]compactRecord(nil), page...)
+	}
+	for i, chunk := range c.arena {
+		if i == len(c.arena)-1 {
+			// keeps room to append to
+			clone.arena[i] = append(make([]byte, 0, COMPACT_ARENA_CHUNK_SIZE), chunk...)
+		} else {
+			clone.arena[i] = append([]byte(nil), chunk...)
+		}
+	}
+	return clone
+}
+
+func (c *compactIndex) newRecord() uint32 {
+	if len(c.free) > 0 {
+		n := c.free[len(c.free)-1]
+		c.free = c.free[:len(c.free)-1]
+		return n
+	}
+	n := len(c.pages) * COMPACT_PAGE_SIZE
+	c.pages = append(c.pages, make([]compactRecord, COMPACT_PAGE_SIZE))
+	// the rest of the new page goes on the free list, highest first so
+	// records are handed out in order
+	for i := n + COMPACT_PAGE_SIZE - 1; i > n; i-- {
+		c.free = append(c.free, uint32(i))
+	}
+	return uint32(n)
+}
+
+// appendKey copies key into the arena and returns its reference
+func (c *compactIndex) appendKey(key Key) uint64 {
+	ref, buf := c.reserve(2 + len(key))
+	byteOrder.PutUint16(buf, uint16(len(key)))
+	copy(buf[2:], key)
+	return ref
+}
+
+// reserve takes size bytes at the end of the arena, only the last chunk is
+// ever appended to
+func (c *compactIndex) reserve(size int) (uint64, []byte) {
+	if len(c.arena) == 0 || len(c.arena[len(c.arena)-1])+size > COMPACT_ARENA_CHUNK_SIZE {
+		c.arena = append(c.arena, make([]byte, 0, COMPACT_ARENA_CHUNK_SIZE))
+	}
+	last := len(c.arena) - 1
+	chunk := c.arena[last]
+	ref := uint64(last)<<32 | uint64(len(chunk))
+	c.arena[last] = chunk[:len(chunk)+size]
+	c.used += size
+	return ref, chunk[len(chunk) : len(chunk)+size]
+}
+
+// compactArena copies the live keys into a new arena
+func (c *compactIndex) compactArena() {
+	old := c.arena
+	c.arena = nil
+	c.used = 0
+	c.garbage = 0
+	for _, n := range c.table {
+		if n == 0 {
+			continue
+		}
+		r := c.record(n - 1)
+		chunk := old[r.key>>32]
+		offset := uint32(r.key)
+		size := 2 + int(byteOrder.Uint16(chunk[offset:]))
+		ref, buf := c.reserve(size)
+		copy(buf, chunk[offset:int(offset)+size])
+		r.key = ref
+	}
+}
+
+// grow doubles the table and reinserts every record at its new home
+func (c *compactIndex) grow() {
+	if c.bits == 32 {
+		panic("memorylanedb: compact index is full")
+	}
+	old := c.table
+	c.bits++
+	c.table = make([]uint32, 1<<c.bits)
+	mask := uint32(len(c.table) - 1)
+	for _, n := range old {
+		if n == 0 {
+			continue
+		}
+		slot := c.home(c.record(n - 1).hash)
+		for c.table[slot] != 0 {
+			slot = (slot + 1) & mask
+		}
+		c.table[slot] = n
+	}
+}
+
+func (r *compactRecord) item() EntryItem {
+	return EntryItem{
+		fileId:      uint(r.fileId),
+		entrySize:   r.entrySize,
+		entryOffset: r.entryOffset,
+		tstamp:      r.tstamp,
+		expiry:      r.expiry,
+		seq:         r.seq,
+	}
+}
+
+func (r *compactRecord) set(item EntryItem) {
+	if item.fileId > math.MaxUint32 {
+		panic("memorylanedb: datafile id does not fit the compact index")
+	}
+	r.fileId = uint32(item.fileId)
+	r.entrySize = item.entrySize
+	r.entryOffset = item.entryOffset
+	r.tstamp = item.tstamp
+	r.expiry = item.expiry
+	r.seq = item.seq
+}
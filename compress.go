@@ -0,0 +1,246 @@
+package memorylanedb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+/*
+	Values are compressed one entry at a time. The id of the compressor is
+	kept in the COMPRESSOR_FLAGS bits of the entry flags, so a datafile can
+	mix entries of any compressor and every entry is decompressed by the one
+	that wrote it, whatever Option.Compressor is now. A merge recompresses
+	the entries it copies into the current setting.
+
+	The checksum covers the stored, compressed value. A value that does not
+	shrink is stored as it is.
+*/
+
+// compressor ids, the ones up to COMPRESSOR_GZIP are the compressors of this
+// package and the rest up to MAX_COMPRESSOR_ID are free for others
+const (
+	COMPRESSOR_NONE uint8 = iota
+	COMPRESSOR_FLATE
+	COMPRESSOR_GZIP
+
+	MAX_COMPRESSOR_ID = COMPRESSOR_FLAGS >> COMPRESSOR_SHIFT
+)
+
+// Compressor compresses values, see Option.Compressor.
+type Compressor interface {
+	// ID is recorded in every entry the compressor wrote, between 1 and
+	// MAX_COMPRESSOR_ID. It must never change meaning.
+	ID() uint8
+	Compress(value []byte) ([]byte, error)
+	// NewReader decompresses what Compress wrote
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// builtinCompressors decode the entries of the package compressors, their
+// level does not matter for that
+var builtinCompressors = map[uint8]Compressor{
+	COMPRESSOR_FLATE: newFlateCompressor(flate.DefaultCompression),
+	COMPRESSOR_GZIP:  newGzipCompressor(gzip.DefaultCompression),
+}
+
+type flateCompressor struct {
+	level   int
+	writers sync.Pool
+}
+
+// NewFlateCompressor returns a Compressor for raw DEFLATE at a
+// compress/flate level.
+func NewFlateCompressor(level int) (Compressor, error) {
+	if _, err := flate.NewWriter(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return newFlateCompressor(level), nil
+}
+
+func newFlateCompressor(level int) *flateCompressor {
+	return &flateCompressor{level: level}
+}
+
+func (c *flateCompressor) ID() uint8 {
+	return COMPRESSOR_FLATE
+}
+
+func (c *flateCompressor) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := c.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		if w, err = flate.NewWriter(&buf, c.level); err != nil {
+			return nil, err
+		}
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+type gzipCompressor struct {
+	level   int
+	writers sync.Pool
+}
+
+// NewGzipCompressor returns a Compressor for gzip at a compress/gzip level.
+func NewGzipCompressor(level int) (Compressor, error) {
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		return nil, err
+	}
+	return newGzipCompressor(level), nil
+}
+
+func newGzipCompressor(level int) *gzipCompressor {
+	return &gzipCompressor{level: level}
+}
+
+func (c *gzipCompressor) ID() uint8 {
+	return COMPRESSOR_GZIP
+}
+
+func (c *gzipCompressor) Compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		if w, err = gzip.NewWriterLevel(&buf, c.level); err != nil {
+			return nil, err
+		}
+	}
+	defer c.writers.Put(w)
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// validateCompressor checks the id of c, the ids of the package compressors
+// are taken by them
+func validateCompressor(c Compressor) error {
+	id := c.ID()
+	if id == COMPRESSOR_NONE || id > MAX_COMPRESSOR_ID {
+		return fmt.Errorf("%w: Compressor ID must be between 1 and %d", ErrInvalidOption, MAX_COMPRESSOR_ID)
+	}
+	if builtin, ok := builtinCompressors[id]; ok && reflect.TypeOf(builtin) != reflect.TypeOf(c) {
+		return fmt.Errorf("%w: Compressor ID %d is reserved", ErrInvalidOption, id)
+	}
+	return nil
+}
+
+// newCompressorTable returns the compressors a DB decodes with by id
+func newCompressorTable(c Compressor) map[uint8]Compressor {
+	table := make(map[uint8]Compressor, len(builtinCompressors)+1)
+	for id, builtin := range builtinCompressors {
+		table[id] = builtin
+	}
+	if c != nil {
+		table[c.ID()] = c
+	}
+	return table
+}
+
+func (e *Entry) Compressor() uint8 {
+	return (e.Flags & COMPRESSOR_FLAGS) >> COMPRESSOR_SHIFT
+}
+
+func (e *Entry) setCompressor(id uint8) {
+	e.Flags = e.Flags&^COMPRESSOR_FLAGS | id<<COMPRESSOR_SHIFT
+}
+
+// compressValue compresses the value of entry with the compressor of the DB,
+// unless that does not make it smaller
+func (db *DB) compressValue(entry *Entry) error {
+	if db.compressor == nil || len(entry.Value) == 0 ||
+		entry.Flags&(FLAG_TOMBSTONE|FLAG_BATCH_COMMIT|FLAG_BLOB) != 0 || entry.Compressor() != COMPRESSOR_NONE {
+		return nil
+	}
+	compressed, err := db.compressor.Compress(entry.Value)
+	if err != nil {
+		return err
+	}
+	if len(compressed) >= len(entry.Value) {
+		return nil
+	}
+	entry.Value = compressed
+	entry.ValueSize = uint32(len(compressed))
+	entry.setCompressor(db.compressor.ID())
+	return nil
+}
+
+// decompressValue returns the value of entry, decompressed by the compressor
+// that wrote it
+func (db *DB) decompressValue(entry *Entry) ([]byte, error) {
+	id := entry.Compressor()
+	if id == COMPRESSOR_NONE {
+		return entry.Value, nil
+	}
+	r, err := db.decompressor(id, bytes.NewReader(entry.Value))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptedData, err)
+	}
+	return value, nil
+}
+
+// decompressor returns a reader that decompresses r with compressor id
+func (db *DB) decompressor(id uint8, r io.Reader) (io.ReadCloser, error) {
+	c, ok := db.compressors[id]
+	if !ok {
+		return nil, ErrUnknownCompressor
+	}
+	rc, err := c.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptedData, err)
+	}
+	return rc, nil
+}
+
+// recompressValue brings the value of entry to the current compressor
+func (db *DB) recompressValue(entry *Entry) error {
+	current := COMPRESSOR_NONE
+	if db.compressor != nil {
+		current = db.compressor.ID()
+	}
+	if entry.Compressor() == current {
+		return nil
+	}
+	value, err := db.decompressValue(entry)
+	if err != nil {
+		return err
+	}
+	entry.Value = value
+	entry.ValueSize = uint32(len(value))
+	entry.setCompressor(COMPRESSOR_NONE)
+	return db.compressValue(entry)
+}
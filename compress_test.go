@@ -0,0 +1,202 @@
+package memorylanedb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+// customCompressor is flate under an id of its own
+type customCompressor struct {
+	*flateCompressor
+}
+
+func (c customCompressor) ID() uint8 {
+	return COMPRESSOR_GZIP + 1
+}
+
+func TestCompression(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"name":"user %d","tags":["a","b","c"],"active":true,"padding":"%s"}`,
+			i, i, bytes.Repeat([]byte("x"), 200)))
+	}
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	gz, err := NewGzipCompressor(gzip.BestCompression)
+	if !assert.NoError(err) {
+		return
+	}
+	fl, err := NewFlateCompressor(flate.BestSpeed)
+	if !assert.NoError(err) {
+		return
+	}
+	open := func(c Compressor) *DB {
+		db, err := NewDB(directory, &Option{Compressor: c})
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		return db
+	}
+	check := func(db *DB) {
+		for i := 0; i < 100; i++ {
+			got, err := db.Get(Key(fmt.Sprintf("key%d", i)))
+			assert.NoError(err)
+			assert.Equal(value(i), got)
+		}
+		got, err := db.Get("random")
+		assert.NoError(err)
+		assert.Equal(random, got)
+	}
+	// compressors counts the entries of every compressor in the datafiles
+	compressors := func(db *DB) map[uint8]int {
+		counts := make(map[uint8]int)
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		files := append([]Datafile{db.activeDataFile}, db.immutableBlobFiles()...)
+		if db.activeBlobFile != nil {
+			files = append(files, db.activeBlobFile)
+		}
+		for _, df := range files {
+			it := df.CreateIterator()
+			for it.hasNext() {
+				entry, err := it.getNext()
+				assert.NoError(err)
+				counts[entry.Compressor()]++
+			}
+		}
+		for _, df := range db.immutableDataFiles {
+			it := df.CreateIterator()
+			for it.hasNext() {
+				entry, err := it.getNext()
+				assert.NoError(err)
+				counts[entry.Compressor()]++
+			}
+		}
+		return counts
+	}
+
+	db := open(fl)
+	for i := 0; i < 100; i++ {
+		assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), value(i)))
+	}
+	assert.NoError(db.Put("random", random))
+
+	t.Run("Compressed", func(t *testing.T) {
+		check(db)
+		assert.Less(db.activeDataFile.Size(), int64(100*len(value(0))/2))
+		// a value that does not shrink is stored as it is
+		assert.Equal(map[uint8]int{COMPRESSOR_FLATE: 100, COMPRESSOR_NONE: 1}, compressors(db))
+
+		r, err := db.GetReader("key7")
+		if !assert.NoError(err) {
+			return
+		}
+		streamed, err := io.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(value(7), streamed)
+		assert.NoError(r.Close())
+	})
+
+	t.Run("MixedFiles", func(t *testing.T) {
+		assert.NoError(db.Close())
+		db = open(gz)
+		for i := 50; i < 100; i++ {
+			assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), value(i)))
+		}
+		check(db)
+		assert.Equal(map[uint8]int{COMPRESSOR_FLATE: 100, COMPRESSOR_GZIP: 50, COMPRESSOR_NONE: 1}, compressors(db))
+	})
+
+	t.Run("MergeRecompresses", func(t *testing.T) {
+		assert.NoError(db.Merge(context.Background()))
+		check(db)
+		assert.Equal(map[uint8]int{COMPRESSOR_GZIP: 100, COMPRESSOR_NONE: 1}, compressors(db))
+
+		assert.NoError(db.Close())
+		db = open(nil)
+		check(db)
+		assert.NoError(db.Merge(context.Background()))
+		check(db)
+		assert.Equal(map[uint8]int{COMPRESSOR_NONE: 101}, compressors(db))
+		assert.NoError(db.Close())
+	})
+
+	t.Run("BlobLog", func(t *testing.T) {
+		db, err := NewDB(t.TempDir(), &Option{Compressor: gz, BlobThreshold: 200})
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		large := []byte(fmt.Sprintf("%x", random))
+		// compresses below the threshold
+		assert.NoError(db.Put("small", value(1)))
+		assert.NoError(db.Put("large", large))
+		assert.NoError(db.Put("random", random))
+		// the pointers are not compressed, the blob of large is
+		assert.Equal(map[uint8]int{COMPRESSOR_GZIP: 2, COMPRESSOR_NONE: 3}, compressors(db))
+		got, err := db.Get("large")
+		assert.NoError(err)
+		assert.Equal(large, got)
+
+		r, err := db.GetReader("large")
+		if !assert.NoError(err) {
+			return
+		}
+		streamed, err := io.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(large, streamed)
+		assert.NoError(r.Close())
+	})
+
+	t.Run("CustomCompressor", func(t *testing.T) {
+		directory := t.TempDir()
+		custom := customCompressor{newFlateCompressor(flate.DefaultCompression)}
+		db, err := NewDB(directory, &Option{Compressor: custom})
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(db.Put("key", value(1)))
+		got, err := db.Get("key")
+		assert.NoError(err)
+		assert.Equal(value(1), got)
+		assert.NoError(db.Close())
+
+		// only a DB set to the custom compressor can decode its entries
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		_, err = db.Get("key")
+		assert.ErrorIs(err, ErrUnknownCompressor)
+	})
+}
+
+type reservedCompressor struct {
+	customCompressor
+}
+
+func (c reservedCompressor) ID() uint8 {
+	return COMPRESSOR_FLATE
+}
+
+func TestCompressorValidation(t *testing.T) {
+	assert := assert2.New(t)
+	_, err := NewDB(t.TempDir(), &Option{Compressor: reservedCompressor{}})
+	assert.ErrorIs(err, ErrInvalidOption)
+	_, err = NewFlateCompressor(42)
+	assert.Error(err)
+	_, err = NewGzipCompressor(42)
+	assert.Error(err)
+}
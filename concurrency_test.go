@@ -0,0 +1,212 @@
+package memorylanedb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+/*
+These tests are meant to be run with -race
+*/
+
+func TestConcurrentAccess(t *testing.T) {
+	assert := assert2.New(t)
+
+	for _, opts := range []Option{
+		{Index: INDEX_HASH},
+		{Index: INDEX_BTREE},
+		{Index: INDEX_COMPACT},
+		{Index: INDEX_HASH, IndexShards: 8},
+		{Index: INDEX_HASH, IndexShards: 8, Mmap: true, CacheSize: 1 << 10},
+		{Index: INDEX_HASH, IndexShards: 8, BlobThreshold: 4},
+	} {
+		opts := opts
+		opts.MaxKeySize, opts.MaxValueSize, opts.MaxDatafileSize = 64, 64, 4096
+		t.Run(fmt.Sprintf("Index%dShards%dMmap%tBlob%d", opts.Index, opts.IndexShards, opts.Mmap, opts.BlobThreshold), func(t *testing.T) {
+			db, err := NewDB(t.TempDir(), &opts)
+			if !assert.NoError(err) {
+				return
+			}
+			defer db.Close()
+
+			var wg sync.WaitGroup
+			run := func(f func(i int)) {
+				for i := 0; i < 4; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						for j := 0; j < 50; j++ {
+							f(i*50 + j)
+						}
+					}(i)
+				}
+			}
+			run(func(i int) {
+				assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), []byte("value")))
+			})
+			run(func(i int) {
+				_, err := db.Get(Key(fmt.Sprintf("key%d", i)))
+				if err != ErrKeyNotFound {
+					assert.NoError(err)
+				}
+				_, err = db.Has(Key(fmt.Sprintf("key%d", i)))
+				assert.NoError(err)
+				db.Stats()
+			})
+			run(func(i int) {
+				b := NewWriteBatch()
+				b.Put(Key(fmt.Sprintf("batch%d", i)), []byte("value"))
+				b.Delete(Key(fmt.Sprintf("key%d", i)))
+				assert.NoError(db.Write(b))
+			})
+			run(func(i int) {
+				txn := db.Begin()
+				txn.Get(Key(fmt.Sprintf("txn%d", i)))
+				assert.NoError(txn.Put(Key(fmt.Sprintf("txn%d", i)), []byte("value")))
+				if err := txn.Commit(); err != ErrTxnConflict {
+					assert.NoError(err)
+				}
+			})
+			run(func(i int) {
+				if i%10 != 0 {
+					return
+				}
+				snap := db.Snapshot()
+				assert.NoError(snap.Fold(func(k Key) error {
+					_, err := snap.Get(k)
+					return err
+				}))
+				assert.NoError(snap.Close())
+
+				it := db.NewIterator(IterOptions{Prefix: "batch"})
+				for it.Next() {
+					it.Value()
+				}
+				assert.NoError(it.Err())
+				assert.NoError(it.Close())
+
+				assert.NoError(db.Fold(func(k Key) error {
+					_, err := db.Get(k)
+					if err == ErrKeyNotFound {
+						return nil
+					}
+					return err
+				}))
+				if opts.Index == INDEX_BTREE {
+					assert.NoError(db.Scan("", "", func(k Key) error { return nil }))
+				}
+			})
+			run(func(i int) {
+				if i%50 != 0 {
+					return
+				}
+				if err := db.Merge(context.Background()); err != ErrMergeInProgress {
+					assert.NoError(err)
+				}
+				assert.NoError(db.Sync())
+			})
+			wg.Wait()
+
+			for i := 0; i < 200; i++ {
+				_, err := db.Get(Key(fmt.Sprintf("batch%d", i)))
+				assert.NoError(err)
+				_, err = db.Get(Key(fmt.Sprintf("txn%d", i)))
+				assert.NoError(err)
+			}
+		})
+	}
+
+	t.Run("WriteFromFold", func(t *testing.T) {
+		db, err := NewDB(t.TempDir(), nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		assert.NoError(db.Put("foo", []byte("bar")))
+		assert.NoError(db.Put("baz", []byte("qux")))
+		assert.NoError(db.Fold(func(k Key) error {
+			return db.Delete(k)
+		}))
+		assert.Equal(0, db.Stats()["keys"])
+	})
+}
+
+func TestClose(t *testing.T) {
+	assert := assert2.New(t)
+
+	t.Run("DuringMerge", func(t *testing.T) {
+		directory := t.TempDir()
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		for i := 0; i < 2000; i++ {
+			assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), []byte("value")))
+		}
+		merged := make(chan error)
+		go func() {
+			merged <- db.Merge(context.Background())
+		}()
+		assert.NoError(db.Close())
+		// the merge either finished before Close or was cancelled by it
+		if err := <-merged; err != nil {
+			assert.ErrorIs(err, ErrDBClosed)
+		}
+
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		assert.Equal(2000, db.Stats()["keys"])
+	})
+
+	t.Run("UseAfterClose", func(t *testing.T) {
+		db, err := NewDB(t.TempDir(), &Option{Index: INDEX_BTREE})
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(db.Put("foo", []byte("bar")))
+		snap := db.Snapshot()
+		it := db.NewIterator(IterOptions{})
+		assert.True(it.Next())
+		assert.NoError(db.Close())
+
+		assert.ErrorIs(db.Close(), ErrDBClosed)
+		assert.ErrorIs(db.Put("foo", []byte("bar")), ErrDBClosed)
+		assert.ErrorIs(db.Delete("foo"), ErrDBClosed)
+		b := NewWriteBatch()
+		b.Put("foo", []byte("bar"))
+		assert.ErrorIs(db.Write(b), ErrDBClosed)
+		assert.ErrorIs(db.Sync(), ErrDBClosed)
+		assert.ErrorIs(db.Merge(context.Background()), ErrDBClosed)
+		_, err = db.Get("foo")
+		assert.ErrorIs(err, ErrDBClosed)
+		_, err = db.Has("foo")
+		assert.ErrorIs(err, ErrDBClosed)
+		assert.ErrorIs(db.Fold(func(Key) error { return nil }), ErrDBClosed)
+		assert.ErrorIs(db.Scan("", "", func(Key) error { return nil }), ErrDBClosed)
+		txn := db.Begin()
+		_, err = txn.Get("foo")
+		assert.ErrorIs(err, ErrDBClosed)
+		assert.NoError(txn.Put("foo", []byte("bar")))
+		assert.ErrorIs(txn.Commit(), ErrDBClosed)
+
+		_, err = snap.Get("foo")
+		assert.ErrorIs(err, ErrDBClosed)
+		assert.NoError(snap.Close())
+		_, err = db.Snapshot().Get("foo")
+		assert.ErrorIs(err, ErrDBClosed)
+
+		assert.Nil(it.Value())
+		assert.ErrorIs(it.Err(), ErrDBClosed)
+		assert.NoError(it.Close())
+		it = db.NewIterator(IterOptions{})
+		assert.False(it.Next())
+		assert.ErrorIs(it.Err(), ErrDBClosed)
+	})
+}
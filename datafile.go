@@ -1,9 +1,12 @@
 package memorylanedb
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"syscall"
 )
 
 var datafileDefaultName = "%04d" + DATAFILE_SUFFIX
@@ -11,29 +14,45 @@ var mergedDatafileDefaultName = "%04d" + MERGED_DATAFILE_SUFFIX
 
 type EntryWithOffset struct {
 	Entry
-	Offset uint32
+	Offset    uint64
+	EntrySize uint64 // bytes the entry takes in the datafile
 }
 
 type Datafile interface {
 	ID() int
 	Name() string
 	Write(Entry) (int64, int64, error)
+	WriteFrom(entry Entry, value io.Reader) (int64, int64, error)
 	Read() (Entry, int64, error)
+	ReadAt(p []byte, offset int64) (int, error)
 	Close() error
 	Size() int64
 	Sync() error
-	ReadFrom(index, size uint32) (Entry, int64, error)
+	Version() uint16
+	// KeyID is the id of the encryption key of the entries, 0 if they are
+	// not encrypted
+	KeyID() uint32
+	// EncryptsKeys reports whether the keys of the entries are encrypted
+	// along with their values
+	EncryptsKeys() bool
+	ReadFrom(offset, size uint64) (Entry, int64, error)
 	CreateIterator() Iterator[EntryWithOffset]
 }
 
 type datafile struct {
 	id         int
 	name       string
-	file       *os.File
+	file       File
 	offset     int64 // byte offset to track writes
+	headerSize int64 // 0 for FORMAT_V0 files
 	codec      *Codec
 	readOnly   bool
 	mergedFile bool
+	blobFile   bool
+	mmap       bool
+	data       []byte   // the mapped file, nil unless memory-mapped
+	keys       *keyring // nil unless the DB is encrypted
+	fs         FS
 }
 
 type DataFileOptions func(df *datafile)
@@ -50,24 +69,54 @@ func AsMergedFile() DataFileOptions {
 	}
 }
 
+// AsBlobFile names the datafile as a blob file, which holds the values of the
+// blob log
+func AsBlobFile() DataFileOptions {
+	return func(df *datafile) {
+		df.blobFile = true
+	}
+}
+
+// AsMemoryMapped maps a read-only datafile into memory, ReadFrom then decodes
+// entries from the mapping instead of reading them with a syscall. It has no
+// effect on writable files or files of an FS other than OSFS.
+func AsMemoryMapped() DataFileOptions {
+	return func(df *datafile) {
+		df.mmap = true
+	}
+}
+
+// OnFS opens the datafile on fsys instead of OSFS
+func OnFS(fsys FS) DataFileOptions {
+	return func(df *datafile) {
+		df.fs = fsys
+	}
+}
+
 // implement iterator pattern
+// the iterator reads through its own codec so it does not share (or disturb)
+// the read position of the datafile
 type datafileIterator struct {
 	current_offset int64
-	df             *datafile
+	size           int64
+	codec          *Codec
 }
 
 func (dfi *datafileIterator) hasNext() bool {
-	return dfi.current_offset < dfi.df.Size()
+	return dfi.current_offset < dfi.size
 }
 
 func (dfi *datafileIterator) getNext() (EntryWithOffset, error) {
-	entry, bytesRead, err := dfi.df.Read()
+	var entry Entry
+	bytesRead, err := dfi.codec.DecodeEntry(&entry)
 	if err != nil {
-		return EntryWithOffset{}, err
+		// the offset tells callers where the undecodable entry starts
+		return EntryWithOffset{Offset: uint64(dfi.current_offset)}, err
 	}
 	entryWithOffset := EntryWithOffset{
 		entry,
-		uint32(dfi.current_offset),
+		uint64(dfi.current_offset),
+		uint64(bytesRead),
 	}
 	dfi.current_offset += bytesRead
 	return entryWithOffset, nil
@@ -75,7 +124,7 @@ func (dfi *datafileIterator) getNext() (EntryWithOffset, error) {
 
 func NewDatafile(directory string, id int, opts ...DataFileOptions) (Datafile, error) {
 	// create new datafile
-	df := &datafile{}
+	df := &datafile{fs: OSFS}
 	for _, o := range opts {
 		o(df)
 	}
@@ -83,16 +132,19 @@ func NewDatafile(directory string, id int, opts ...DataFileOptions) (Datafile, e
 	name := fmt.Sprintf(datafileDefaultName, id)
 	if df.mergedFile {
 		name = fmt.Sprintf(mergedDatafileDefaultName, id)
+	} else if df.blobFile {
+		name = fmt.Sprintf(blobfileDefaultName, id)
 	}
 	path := filepath.Join(directory, name)
-	var f *os.File
+	var f File
 	var fErr error
 
 	if df.readOnly {
-		f, fErr = os.OpenFile(path, os.O_RDONLY, 0400)
+		f, fErr = df.fs.OpenFile(path, os.O_RDONLY, 0400)
 
 	} else {
-		f, fErr = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+		// not O_APPEND, WriteFrom goes back to fill in the checksum
+		f, fErr = df.fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
 	}
 	if fErr != nil {
 		return nil, fErr
@@ -104,20 +156,90 @@ func NewDatafile(directory string, id int, opts ...DataFileOptions) (Datafile, e
 	}
 
 	codec := NewCodec(f)
+	codec.keys = df.keys
+	// a new writable file starts with a header, existing files tell the
+	// codec which format and key they are in
+	var headerSize int64
+	if stat.Size() == 0 && !df.readOnly {
+		headerSize, err = codec.EncodeHeader(datafileMagic)
+	} else {
+		headerSize, err = codec.DecodeHeader(datafileMagic)
+		if err == nil && codec.Version() == FORMAT_V0 && stat.Size() > 0 {
+			err = checkLegacyDatafile(f, stat.Size())
+		}
+	}
+	if err == nil && !df.readOnly {
+		// reading the header moved the file position
+		_, err = f.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 
 	df.id = id
 	df.name = stat.Name()
 	df.file = f
 	df.offset = stat.Size()
+	if stat.Size() == 0 {
+		// only holds the header we just wrote
+		df.offset = headerSize
+	}
+	df.headerSize = headerSize
 	df.codec = codec
 
+	if osFile, ok := f.(*os.File); ok && df.readOnly && df.mmap && stat.Size() > 0 {
+		df.data, err = syscall.Mmap(int(osFile.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
 	return df, nil
 }
 
+// checkLegacyDatafile makes sure a headerless file starts with a valid
+// FORMAT_V0 entry, so a foreign file is not mistaken for a datafile
+func checkLegacyDatafile(f File, size int64) error {
+	codec := NewReaderCodec(f, FORMAT_V0)
+	prefixSize := codec.entryHeaderSize()
+	if size < prefixSize {
+		return ErrInvalidFileHeader
+	}
+	buf := make([]byte, prefixSize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	var entry Entry
+	if err := codec.decodeEntryPrefix(buf, &entry); err != nil {
+		return err
+	}
+	entrySize := prefixSize + int64(entry.KeySize) + int64(entry.ValueSize)
+	if entry.KeySize == 0 || entry.KeySize > MAX_KEY_SIZE || entrySize > size {
+		return ErrInvalidFileHeader
+	}
+	buf = make([]byte, entrySize)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	if _, err := codec.DecodeSingleEntry(buf, &entry); err != nil {
+		if err == ErrCorruptedData {
+			return ErrInvalidFileHeader
+		}
+		return err
+	}
+	return nil
+}
+
 func (df *datafile) CreateIterator() Iterator[EntryWithOffset] {
+	size := df.Size()
+	codec := NewReaderCodec(io.NewSectionReader(df.file, df.headerSize, size-df.headerSize), df.codec.Version())
+	codec.sealing = df.codec.sealing
 	return &datafileIterator{
-		current_offset: 0,
-		df:             df,
+		current_offset: df.headerSize,
+		size:           size,
+		codec:          codec,
 	}
 }
 
@@ -132,11 +254,25 @@ func (df *datafile) Name() string {
 func (df *datafile) Type() string {
 	if df.mergedFile {
 		return "merged-datafile"
+	} else if df.blobFile {
+		return "blobfile"
 	} else {
 		return "datafile"
 	}
 }
 
+func (df *datafile) Version() uint16 {
+	return df.codec.Version()
+}
+
+func (df *datafile) KeyID() uint32 {
+	return df.codec.KeyID()
+}
+
+func (df *datafile) EncryptsKeys() bool {
+	return df.codec.sealing != nil && df.codec.sealing.keys
+}
+
 func (df *datafile) Size() int64 {
 	return df.offset
 }
@@ -148,10 +284,59 @@ func (df *datafile) Write(entry Entry) (offset_before_write int64, bytesWritten
 	}
 	offset_before_write = df.offset
 	bytesWritten, err = df.codec.EncodeEntry(&entry)
+	if err != nil {
+		// a failed write may have left part of the entry behind
+		err = df.rollback(offset_before_write, err)
+		bytesWritten = 0
+		return
+	}
+	df.offset += bytesWritten
+	return
+}
+
+// WriteFrom appends an entry whose value is streamed from value, see
+// Codec.EncodeEntryFrom. If value fails or runs short the file is cut back to
+// where the entry started.
+func (df *datafile) WriteFrom(entry Entry, value io.Reader) (offset_before_write int64, bytesWritten int64, err error) {
+	if df.readOnly {
+		err = ErrReadOnlyDataFile
+		return
+	}
+	offset_before_write = df.offset
+	bytesWritten, err = df.codec.EncodeEntryFrom(&entry, value)
+	if err == nil {
+		crc := make([]byte, CRC_SIZE)
+		byteOrder.PutUint32(crc, entry.Checksum)
+		_, err = df.file.WriteAt(crc, offset_before_write)
+	}
+	if err != nil {
+		err = df.rollback(offset_before_write, err)
+		bytesWritten = 0
+		return
+	}
 	df.offset += bytesWritten
 	return
 }
 
+// rollback cuts the file back to where a failed write started, returning the
+// error of the write unless that fails too
+func (df *datafile) rollback(offset int64, err error) error {
+	df.codec.w.Reset(df.file)
+	if truncErr := df.truncate(offset); truncErr != nil {
+		return truncErr
+	}
+	return err
+}
+
+// truncate drops everything written after size
+func (df *datafile) truncate(size int64) error {
+	if err := df.file.Truncate(size); err != nil {
+		return err
+	}
+	_, err := df.file.Seek(size, io.SeekStart)
+	return err
+}
+
 func (df *datafile) Read() (entry Entry, bytesRead int64, err error) {
 	// codec has the filehandler, so can keep track of reads
 	// decode single entry from underlying data file
@@ -159,9 +344,12 @@ func (df *datafile) Read() (entry Entry, bytesRead int64, err error) {
 	return
 }
 
-func (df *datafile) ReadFrom(index, size uint32) (entry Entry, bytesRead int64, err error) {
+func (df *datafile) ReadFrom(offset, size uint64) (entry Entry, bytesRead int64, err error) {
+	if df.data != nil {
+		return df.readMapped(offset, size)
+	}
 	buf := make([]byte, size)
-	_, err = df.file.ReadAt(buf, int64(index))
+	_, err = df.file.ReadAt(buf, int64(offset))
 	if err != nil {
 		return
 	}
@@ -169,14 +357,52 @@ func (df *datafile) ReadFrom(index, size uint32) (entry Entry, bytesRead int64,
 	return
 }
 
-func (df *datafile) Close() error {
-	// flush from in-memory fs cache to disk
-	err := df.Sync()
+// readMapped decodes the entry in place and copies out only its key and value,
+// the mapping goes away when the file is closed
+func (df *datafile) readMapped(offset, size uint64) (entry Entry, bytesRead int64, err error) {
+	end := offset + size
+	if end < offset || end > uint64(len(df.data)) {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	bytesRead, err = df.codec.DecodeSingleEntry(df.data[offset:end], &entry)
 	if err != nil {
-		return err
+		return
 	}
-	return df.file.Close()
+	buf := make([]byte, len(entry.Key)+len(entry.Value))
+	copy(buf, entry.Key)
+	copy(buf[len(entry.Key):], entry.Value)
+	entry.Key = buf[:len(entry.Key):len(entry.Key)]
+	entry.Value = buf[len(entry.Key):]
+	return
+}
 
+// ReadAt reads from the datafile, through the mapping if it is memory-mapped
+func (df *datafile) ReadAt(p []byte, offset int64) (int, error) {
+	if df.data == nil {
+		return df.file.ReadAt(p, offset)
+	}
+	if offset >= int64(len(df.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, df.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close syncs the file, unmaps it and closes it. A failed step does not stop
+// the others, as the file is unusable either way; their errors are joined.
+func (df *datafile) Close() error {
+	// flush from in-memory fs cache to disk
+	errs := []error{df.Sync()}
+	if df.data != nil {
+		errs = append(errs, syscall.Munmap(df.data))
+		df.data = nil
+	}
+	errs = append(errs, df.file.Close())
+	return errors.Join(errs...)
 }
 
 func (df *datafile) Sync() error {
@@ -1,6 +1,9 @@
 package memorylanedb
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"testing"
 
 	assert2 "github.com/stretchr/testify/assert"
@@ -17,3 +20,113 @@ func TestMultipleDatafiles(t *testing.T) {
 	}
 
 }
+
+func TestMemoryMappedDatafile(t *testing.T) {
+	assert := assert2.New(t)
+
+	directory := t.TempDir()
+	df, err := NewDatafile(directory, 1)
+	if !assert.NoError(err) {
+		return
+	}
+	type location struct{ offset, size int64 }
+	var locations []location
+	for i := 0; i < 10; i++ {
+		offset, size, err := df.Write(NewEntry([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+		assert.NoError(err)
+		locations = append(locations, location{offset, size})
+	}
+	assert.NoError(df.Close())
+
+	df, err = NewDatafile(directory, 1, AsReadOnly(), AsMemoryMapped())
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NotNil(df.(*datafile).data)
+	var values [][]byte
+	for i, l := range locations {
+		entry, _, err := df.ReadFrom(uint64(l.offset), uint64(l.size))
+		assert.NoError(err)
+		assert.Equal([]byte(fmt.Sprintf("key%d", i)), entry.Key)
+		values = append(values, entry.Value)
+	}
+	last := locations[len(locations)-1]
+	_, _, err = df.ReadFrom(uint64(last.offset), uint64(last.size+1))
+	assert.ErrorIs(err, io.ErrUnexpectedEOF)
+
+	assert.NoError(df.Close())
+	assert.Nil(df.(*datafile).data)
+	// the values were copied out of the mapping
+	for i, value := range values {
+		assert.Equal([]byte(fmt.Sprintf("value%d", i)), value)
+	}
+
+	t.Run("DB", func(t *testing.T) {
+		db, err := NewDB(t.TempDir(), &Option{Mmap: true})
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		assert.NoError(db.Put("foo", []byte("bar")))
+		assert.NoError(db.Put("baz", []byte("qux")))
+		db.mu.Lock()
+		assert.NoError(db.rotate())
+		db.mu.Unlock()
+		value, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+
+		// the snapshot keeps reading the merged away file through its mapping
+		snap := db.Snapshot()
+		assert.NoError(db.Put("foo", []byte("changed")))
+		assert.NoError(db.Merge(context.Background()))
+		value, err = snap.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		assert.NoError(snap.Close())
+
+		for id, df := range db.immutableDataFiles {
+			assert.NotNil(df.(*datafile).data, "datafile %d", id)
+		}
+		value, err = db.Get("baz")
+		assert.NoError(err)
+		assert.Equal([]byte("qux"), value)
+	})
+}
+
+func BenchmarkReadFrom(b *testing.B) {
+	directory := b.TempDir()
+	df, err := NewDatafile(directory, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	offset, size, err := df.Write(NewEntry([]byte("key"), make([]byte, 100)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := df.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, mmap := range []bool{false, true} {
+		opts := []DataFileOptions{AsReadOnly()}
+		name := "ReadAt"
+		if mmap {
+			opts = append(opts, AsMemoryMapped())
+			name = "Mmap"
+		}
+		b.Run(name, func(b *testing.B) {
+			df, err := NewDatafile(directory, 1, opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer df.Close()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := df.ReadFrom(uint64(offset), uint64(size)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,27 +1,175 @@
 package memorylanedb
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
-	"strings"
 	"sync"
-	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
 type Option struct {
-	SyncOnWrite  bool
+	// SyncOnWrite is SyncMode SYNC_ALWAYS, kept for existing callers
+	SyncOnWrite bool
+	SyncMode    SyncMode
+	// SyncInterval is how often SYNC_INTERVAL fsyncs
+	SyncInterval time.Duration
+
+	// size limits, a limit left at zero takes the value of DefaultOptions
+	MaxKeySize   int
 	MaxValueSize uint32
+	// MaxDatafileSize is the size at which the active file is rotated, an
+	// entry or a WriteBatch larger than it still goes into a single datafile
+	MaxDatafileSize int64
+	// MaxMergefileSize is the size at which a merge starts a new merged
+	// datafile or blob file
+	MaxMergefileSize int64
+	// Index selects the keyDir structure, Scan and ReverseScan need
+	// INDEX_BTREE.
+	Index IndexType
+	// IndexShards splits an INDEX_HASH keyDir into this many shards with a
+	// lock each, so Get and Has scale across cores instead of sharing the DB
+	// lock with writers. Zero or one keeps a single index.
+	IndexShards int
+	// Mmap memory-maps the immutable datafiles, so Get reads them without a
+	// syscall
+	Mmap bool
+	// CacheSize is the number of bytes of keys and values kept in an LRU
+	// cache in front of the datafiles, zero disables the cache
+	CacheSize int64
+	// Compressor compresses every value written from now on, nil stores
+	// them uncompressed. Values are always decompressed by the compressor
+	// that wrote them, a merge recompresses them with this one.
+	Compressor Compressor
+	// BlobThreshold moves values larger than this many bytes out of the
+	// datafiles into a blob log, so merges do not rewrite them. Zero keeps
+	// every value in the datafiles.
+	BlobThreshold uint32
+	// BlobMinDeadRatio is the fraction of a blob file that must be dead for
+	// a merge to copy its live values and remove it, zero takes
+	// DEFAULT_BLOB_MIN_DEAD_RATIO
+	BlobMinDeadRatio float64
+	// EncryptionKeys encrypts the values written from now on with AES-GCM,
+	// under the key with the highest id. A key is 16, 24 or 32 bytes and
+	// id 0 is reserved. Files name the key they were written with, so a key
+	// has to be kept until a merge has rewritten its files with a newer one.
+	EncryptionKeys map[uint32][]byte
+	// EncryptKeys encrypts the keys of entries as well as their values
+	EncryptKeys bool
+	// FS is the filesystem the DB keeps its files in, nil is OSFS
+	FS FS
+
+	// MergeInterval is how often the background scheduler considers running
+	// a merge. Zero disables automatic merges; Merge can still be called.
+	MergeInterval time.Duration
+	// MergeMinDeadRatio only lets the scheduler merge once at least this
+	// fraction of the immutable datafile bytes is dead.
+	MergeMinDeadRatio float64
+	// MergeWindow restricts scheduled merges to a time of day.
+	MergeWindow *MergeWindow
 }
 
 var DefaultOptions = &Option{
-	MaxValueSize: MAX_VALUE_SIZE,
+	MaxKeySize:       MAX_KEY_SIZE,
+	MaxValueSize:     MAX_VALUE_SIZE,
+	MaxDatafileSize:  MAX_DATAFILE_SIZE,
+	MaxMergefileSize: MAX_MERGEFILE_SIZE,
+}
+
+func (opts Option) withDefaults() Option {
+	if opts.SyncOnWrite && opts.SyncMode == SYNC_NEVER {
+		opts.SyncMode = SYNC_ALWAYS
+	}
+	if opts.MaxKeySize == 0 {
+		opts.MaxKeySize = DefaultOptions.MaxKeySize
+	}
+	if opts.MaxValueSize == 0 {
+		opts.MaxValueSize = DefaultOptions.MaxValueSize
+	}
+	if opts.MaxDatafileSize == 0 {
+		opts.MaxDatafileSize = DefaultOptions.MaxDatafileSize
+	}
+	if opts.MaxMergefileSize == 0 {
+		opts.MaxMergefileSize = DefaultOptions.MaxMergefileSize
+	}
+	if opts.BlobMinDeadRatio == 0 {
+		opts.BlobMinDeadRatio = DEFAULT_BLOB_MIN_DEAD_RATIO
+	}
+	return opts
+}
+
+func (opts Option) validate() error {
+	switch opts.SyncMode {
+	case SYNC_NEVER, SYNC_ALWAYS, SYNC_GROUP:
+	case SYNC_INTERVAL:
+		if opts.SyncInterval <= 0 {
+			return fmt.Errorf("%w: SYNC_INTERVAL needs a positive SyncInterval", ErrInvalidOption)
+		}
+	default:
+		return fmt.Errorf("%w: unknown SyncMode %d", ErrInvalidOption, opts.SyncMode)
+	}
+	if opts.IndexShards < 0 || (opts.IndexShards > 1 && opts.Index != INDEX_HASH) {
+		return fmt.Errorf("%w: only INDEX_HASH can be split into IndexShards", ErrInvalidOption)
+	}
+	if opts.CacheSize < 0 {
+		return fmt.Errorf("%w: CacheSize must not be negative", ErrInvalidOption)
+	}
+	if opts.BlobMinDeadRatio < 0 || opts.BlobMinDeadRatio > 1 {
+		return fmt.Errorf("%w: BlobMinDeadRatio must be between 0 and 1", ErrInvalidOption)
+	}
+	if opts.MergeInterval < 0 {
+		return fmt.Errorf("%w: MergeInterval must not be negative", ErrInvalidOption)
+	}
+	if opts.MergeMinDeadRatio < 0 || opts.MergeMinDeadRatio > 1 {
+		return fmt.Errorf("%w: MergeMinDeadRatio must be between 0 and 1", ErrInvalidOption)
+	}
+	if w := opts.MergeWindow; w != nil {
+		day := 24 * time.Hour
+		if w.Start < 0 || w.Start >= day || w.End < 0 || w.End >= day || w.Start == w.End {
+			return fmt.Errorf("%w: MergeWindow must lie within a day and not be empty", ErrInvalidOption)
+		}
+	}
+	if opts.Compressor != nil {
+		if err := validateCompressor(opts.Compressor); err != nil {
+			return err
+		}
+	}
+	// sealing makes the stored key and value larger
+	var keyOverhead, valueOverhead int64
+	if len(opts.EncryptionKeys) > 0 {
+		valueOverhead = SEAL_OVERHEAD
+		if opts.EncryptKeys {
+			keyOverhead = SEAL_OVERHEAD
+		}
+	}
+	if maxKeySize := math.MaxUint16 - keyOverhead; opts.MaxKeySize < 0 || int64(opts.MaxKeySize) > maxKeySize {
+		return fmt.Errorf("%w: MaxKeySize must be between 1 and %d", ErrInvalidOption, maxKeySize)
+	}
+	if maxValueSize := math.MaxUint32 - valueOverhead; int64(opts.MaxValueSize) > maxValueSize {
+		return fmt.Errorf("%w: MaxValueSize must be at most %d", ErrInvalidOption, maxValueSize)
+	}
+	// an entry larger than a file limit goes into a file of its own
+	limits := []struct {
+		name string
+		size int64
+	}{
+		{"MaxDatafileSize", opts.MaxDatafileSize},
+		{"MaxMergefileSize", opts.MaxMergefileSize},
+	}
+	for _, l := range limits {
+		if l.size <= FILE_HEADER_SIZE {
+			return fmt.Errorf("%w: %s must be larger than the file header", ErrInvalidOption, l.name)
+		}
+	}
+	return nil
 }
 
 type foldFunc func(key Key) error
@@ -30,45 +178,148 @@ const (
 	DATAFILE_SUFFIX        = ".datafile"
 	MERGED_DATAFILE_SUFFIX = ".datafile.merged"
 	HINTFILE_SUFFIX        = ".hintfile"
-	TOMBSTONE_VALUE        = "XXXX"
+	// TOMBSTONE_VALUE marked deletions in FORMAT_V0 datafiles, newer formats
+	// use FLAG_TOMBSTONE
+	TOMBSTONE_VALUE = "XXXX"
 )
 
+// DB is safe for concurrent use by multiple goroutines. Reads (Get, Has,
+// Snapshot, NewIterator, Stats) run in parallel with each other, writes (Put,
+// Delete, Write, Txn.Commit) are serialized, and Merge runs alongside both,
+// taking the lock only to start and to commit. Fold and Scan call their
+// function without holding the lock, so it may read from and write to the DB.
+// Once Close has been called every method returns ErrDBClosed; Close itself
+// cancels a running merge and waits for it to return.
 type DB struct {
 	path               string
-	instanceFD         uintptr
-	mu                 sync.RWMutex      // use rw mutex for multiple readers to read the state
-	keyDir             map[Key]EntryItem // map is not concurrent safe
+	fs                 FS
+	lock               io.Closer    // held on the directory while the DB is open
+	mu                 sync.RWMutex // use rw mutex for multiple readers to read the state
+	keyDir             index        // not concurrent safe, guarded by mu
 	activeDataFile     Datafile
 	immutableDataFiles map[int]Datafile // maps file ids to datafiles
+	activeBlobFile     Datafile         // nil until a value goes into the blob log
+	blobFiles          map[int]Datafile // immutable blob files
+	obsoleteFiles      map[int]Datafile // merged away but still pinned by a snapshot
+	fileRefs           map[int]int      // number of snapshots pinning each file id
 	maxFileId          int
+	seq                uint64 // last sequence number handed to a keyDir entry
+	maxKeySize         int
 	maxValueSize       uint32
-	syncOnWrite        bool
+	maxDatafileSize    int64
+	maxMergefileSize   int64
+	mmap               bool
+	cache              *valueCache          // nil if Option.CacheSize is zero
+	compressor         Compressor           // nil if values are not compressed
+	compressors        map[uint8]Compressor // decode entries by their compressor id
+	blobThreshold      uint32
+	blobMinDeadRatio   float64
+	keys               *keyring // nil if files are not encrypted
+	syncMode           SyncMode
+	syncInterval       time.Duration
+	appended           uint64 // number of entries appended to datafiles, see groupSync
+	staged             uint64 // number of values staged by PutReader, atomic
+	group              groupSync
+	merging            bool // set while a merge is running, guarded by mu
+	closed             bool // set by Close, guarded by mu
+	fileStats          map[int]*DatafileStats
+
+	// a failed sync makes the DB read-only, see Sync
+	failMu sync.Mutex
+	failed error // the error of the failed sync, guarded by failMu
+
+	// background merge scheduler
+	mergeInterval     time.Duration
+	mergeMinDeadRatio float64
+	mergeWindow       *MergeWindow
+	now               func() time.Time   // clock used for expiry
+	done              <-chan struct{}    // closed once Close starts
+	stopBackground    context.CancelFunc // closes done
+	wg                sync.WaitGroup     // background goroutines and running merges
 }
 
 func NewDB(path string, opts *Option) (*DB, error) {
-	fd, err := open(path)
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	options := opts.withDefaults()
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	opts = &options
+
+	keys, err := newKeyring(opts.EncryptionKeys, opts.EncryptKeys)
 	if err != nil {
 		return nil, err
 	}
 
-	if opts == nil {
-		opts = DefaultOptions
+	fsys := opts.FS
+	if fsys == nil {
+		fsys = OSFS
+	}
+	lock, err := open(fsys, path)
+	if err != nil {
+		return nil, err
 	}
 
-	state := make(map[Key]EntryItem)
+	state := newIndex(opts.Index, opts.IndexShards)
 	db := DB{
 		path:               path,
-		instanceFD:         *fd,
+		fs:                 fsys,
+		lock:               lock,
 		keyDir:             state,
 		immutableDataFiles: make(map[int]Datafile),
+		blobFiles:          make(map[int]Datafile),
+		obsoleteFiles:      make(map[int]Datafile),
+		fileRefs:           make(map[int]int),
+		fileStats:          make(map[int]*DatafileStats),
+		maxKeySize:         opts.MaxKeySize,
 		maxValueSize:       opts.MaxValueSize,
-		syncOnWrite:        opts.SyncOnWrite,
+		maxDatafileSize:    opts.MaxDatafileSize,
+		maxMergefileSize:   opts.MaxMergefileSize,
+		mmap:               opts.Mmap,
+		compressor:         opts.Compressor,
+		compressors:        newCompressorTable(opts.Compressor),
+		blobThreshold:      opts.BlobThreshold,
+		blobMinDeadRatio:   opts.BlobMinDeadRatio,
+		keys:               keys,
+		syncMode:           opts.SyncMode,
+		syncInterval:       opts.SyncInterval,
+		mergeInterval:      opts.MergeInterval,
+		mergeMinDeadRatio:  opts.MergeMinDeadRatio,
+		mergeWindow:        opts.MergeWindow,
+		now:                time.Now,
+	}
+	if opts.CacheSize > 0 {
+		db.cache = newValueCache(opts.CacheSize)
+	}
+	if err := db.recoverMerge(); err != nil {
+		db.lock.Close()
+		return nil, err
+	}
+	// values a PutReader of the previous process did not finish
+	if err := db.fs.RemoveAll(filepath.Join(db.path, STAGING_DIRNAME)); err != nil {
+		db.lock.Close()
+		return nil, err
 	}
 	loadErr := db.loadDB()
 	if loadErr != nil {
-		loadErr = db.Close()
+		db.closeFiles()
+		db.lock.Close()
 		return nil, loadErr
 	}
+	db.group.cond = sync.NewCond(&db.group.mu)
+	ctx, cancel := context.WithCancel(context.Background())
+	db.done = ctx.Done()
+	db.stopBackground = cancel
+	if db.mergeInterval > 0 {
+		db.wg.Add(1)
+		go db.runMergeScheduler(ctx)
+	}
+	if db.syncMode == SYNC_INTERVAL {
+		db.wg.Add(1)
+		go db.runSyncer(ctx)
+	}
 	return &db, nil
 }
 
@@ -76,73 +327,198 @@ func NewDB(path string, opts *Option) (*DB, error) {
 Bitcask APIs
 */
 func (db *DB) Put(key Key, value []byte) error {
-	// validate key length
-	if key.length() == 0 {
-		return ErrKeyZeroLength
+	return db.putWithExpiry(key, value, 0)
+}
+
+// PutWithTTL stores value under key until ttl has passed, after which the key
+// reads as deleted and the next merge drops it. Expiry has a resolution of a
+// second and is rounded up, and cannot be later than 2106.
+func (db *DB) PutWithTTL(key Key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
 	}
-	// validate key and value sizes
-	if key.length() > MAX_KEY_SIZE {
-		return ErrKeyGreaterThanMax
+	expiry := db.now().Add(ttl)
+	expirySecs := expiry.Unix()
+	if expiry.Nanosecond() > 0 {
+		expirySecs++
 	}
-	if len(value) > int(db.maxValueSize) {
-		return ErrValueGreaterThanMax
+	// expiry is stored in seconds as a uint32
+	if expirySecs > math.MaxUint32 {
+		return ErrInvalidTTL
 	}
-	// append to active file
-	if err := db.put([]byte(key), value); err != nil {
+	return db.putWithExpiry(key, value, uint32(expirySecs))
+}
+
+func (db *DB) putWithExpiry(key Key, value []byte, expiry uint32) error {
+	if err := db.validateKey(key); err != nil {
 		return err
 	}
-	return nil
+	// validate value size
+	if len(value) > int(db.maxValueSize) {
+		return ErrValueGreaterThanMax
+	}
+	entry := NewEntry([]byte(key), value)
+	entry.Expiry = expiry
+
+	return db.update(func() error {
+		// append to active file
+		entryItem, err := db.put(entry)
+		if err != nil {
+			return err
+		}
+		db.setKey(key, entryItem)
+		return nil
+	})
 }
 
 func (db *DB) Get(key Key) ([]byte, error) {
-	item, ok := db.keyDir[key]
-	if !ok {
-		return nil, ErrKeyNotFound
+	if s, ok := db.keyDir.(*shardedIndex); ok {
+		return db.getShared(s, key)
 	}
-	fileID := int(item.fileId)
-	var df Datafile
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	value, _, err := db.get(key)
+	return value, err
+}
 
-	if fileID == db.activeDataFile.ID() {
-		df = db.activeDataFile
-	} else {
-		df, ok = db.immutableDataFiles[fileID]
-		if !ok {
-			return nil, ErrKeyNotFound
-		}
+// get returns the value of key and the sequence number it was written with;
+// callers must hold mu
+func (db *DB) get(key Key) ([]byte, uint64, error) {
+	if db.closed {
+		return nil, 0, ErrDBClosed
 	}
-	entry, _, err := df.ReadFrom(item.entryOffset, item.entrySize)
+	item, ok := db.keyDir.Get(key)
+	if !ok || item.isExpired(db.now()) {
+		return nil, 0, ErrKeyNotFound
+	}
+	value, err := db.readValue(key, item)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	value := entry.Value
-	if entry.Checksum != crc32.ChecksumIEEE(value) {
-		return nil, ErrCorruptedData
+	return value, item.seq, nil
+}
+
+// readValue reads and verifies the value of key from its entry at item;
+// callers must hold mu
+func (db *DB) readValue(key Key, item EntryItem) ([]byte, error) {
+	return db.readCached(key, item, db.datafile)
+}
+
+// datafile finds an open datafile by id; callers must hold mu
+func (db *DB) datafile(id int) (Datafile, bool) {
+	if df, ok := db.liveDatafile(id); ok {
+		return df, true
 	}
-	return value, nil
+	df, ok := db.obsoleteFiles[id]
+	return df, ok
+}
 
+// liveDatafile finds the active or an immutable datafile or blob file by id;
+// callers must hold mu or a shard lock of a sharded keyDir
+func (db *DB) liveDatafile(id int) (Datafile, bool) {
+	if id == db.activeDataFile.ID() {
+		return db.activeDataFile, true
+	}
+	if df, ok := db.immutableDataFiles[id]; ok {
+		return df, true
+	}
+	return db.blobFile(id)
 }
 
 func (db *DB) Has(key Key) (bool, error) {
-	_, ok := db.keyDir[key]
-	return ok, nil
+	if s, ok := db.keyDir.(*shardedIndex); ok {
+		return db.hasShared(s, key)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return false, ErrDBClosed
+	}
+	item, ok := db.keyDir.Get(key)
+	return ok && !item.isExpired(db.now()), nil
 }
 
 func (db *DB) Delete(key Key) error {
-	// write tombstone value in datafile
-	if err := db.Put(key, []byte(TOMBSTONE_VALUE)); err != nil {
+	if err := db.validateKey(key); err != nil {
 		return err
 	}
-	// delete key from state
-	delete(db.keyDir, key)
-	return nil
+	return db.update(func() error {
+		// write tombstone in datafile
+		entryItem, err := db.put(NewTombstone([]byte(key)))
+		if err != nil {
+			return err
+		}
+		// delete key from state, the tombstone itself is dead on arrival
+		db.deleteKey(key)
+		db.statsFor(entryItem.fileId).DeadBytes += int64(entryItem.entrySize)
+		return nil
+	})
 }
 
+// Fold calls f for every key. The keys are collected first and f runs without
+// holding the lock, so it may call back into the DB; a key deleted while Fold
+// runs is still passed to f.
 func (db *DB) Fold(f foldFunc) error {
 	db.mu.RLock()
-	defer db.mu.RUnlock()
-	for k := range db.keyDir {
-		err := f(k)
-		if err != nil {
+	if db.closed {
+		db.mu.RUnlock()
+		return ErrDBClosed
+	}
+	keys := db.liveKeys(db.keyDir.Range)
+	db.mu.RUnlock()
+	return foldKeys(keys, f)
+}
+
+// Scan calls f for every key in [start, end) in ascending order. An empty start
+// or end leaves that side of the range open. The DB must have been opened
+// with INDEX_BTREE. Like Fold, f runs without holding the lock.
+func (db *DB) Scan(start, end Key, f foldFunc) error {
+	return db.scan(start, end, false, f)
+}
+
+// ReverseScan is Scan in descending order.
+func (db *DB) ReverseScan(start, end Key, f foldFunc) error {
+	return db.scan(start, end, true, f)
+}
+
+func (db *DB) scan(start, end Key, reverse bool, f foldFunc) error {
+	db.mu.RLock()
+	if db.closed {
+		db.mu.RUnlock()
+		return ErrDBClosed
+	}
+	ordered, ok := db.keyDir.(orderedIndex)
+	if !ok {
+		db.mu.RUnlock()
+		return ErrIndexNotOrdered
+	}
+	keys := db.liveKeys(func(visit func(Key, EntryItem) bool) {
+		if reverse {
+			ordered.Descend(start, end, visit)
+		} else {
+			ordered.Ascend(start, end, visit)
+		}
+	})
+	db.mu.RUnlock()
+	return foldKeys(keys, f)
+}
+
+// liveKeys collects the unexpired keys that walk visits; callers must hold mu
+func (db *DB) liveKeys(walk func(visit func(Key, EntryItem) bool)) []Key {
+	now := db.now()
+	var keys []Key
+	walk(func(k Key, item EntryItem) bool {
+		if !item.isExpired(now) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	return keys
+}
+
+func foldKeys(keys []Key, f foldFunc) error {
+	for _, k := range keys {
+		if err := f(k); err != nil {
 			return err
 		}
 	}
@@ -150,151 +526,351 @@ func (db *DB) Fold(f foldFunc) error {
 }
 
 func (db *DB) Stats() map[string]any {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	stats := make(map[string]any)
-	stats["keys"] = len(db.keyDir)
+	stats["keys"] = db.keyDir.Len()
 	stats["maxFileId"] = db.maxFileId
+
+	datafiles := make([]DatafileStats, 0, len(db.fileStats))
+	var live, dead int64
+	for _, st := range db.fileStats {
+		datafiles = append(datafiles, *st)
+		live += st.LiveBytes
+		dead += st.DeadBytes
+	}
+	sort.Slice(datafiles, func(i, j int) bool {
+		return datafiles[i].ID < datafiles[j].ID
+	})
+	stats["datafiles"] = datafiles
+	stats["liveBytes"] = live
+	stats["deadBytes"] = dead
+	if db.blobThreshold > 0 || len(db.blobFiles) > 0 {
+		var blobBytes int64
+		for _, bf := range db.blobFiles {
+			blobBytes += bf.Size()
+		}
+		if db.activeBlobFile != nil {
+			blobBytes += db.activeBlobFile.Size()
+		}
+		stats["blobFiles"] = len(db.blobFiles)
+		stats["blobBytes"] = blobBytes
+	}
+	if db.cache != nil {
+		hits, misses, size := db.cache.stats()
+		stats["cacheHits"] = hits
+		stats["cacheMisses"] = misses
+		stats["cacheBytes"] = size
+	}
 	return stats
 }
 
-func (db *DB) sync() error {
-	return db.activeDataFile.Sync()
+// Close waits for a running merge to be cancelled, then closes the datafiles
+// and releases the directory lock. Calls made after Close return ErrDBClosed.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrDBClosed
+	}
+	unlock := db.lockReaders()
+	db.closed = true
+	unlock()
+	db.mu.Unlock()
+
+	// stop the background goroutines and running merges before the files
+	// they use are closed
+	db.stopBackground()
+	db.wg.Wait()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	err := db.closeFiles()
+	// releases the directory for other processes, even if a file failed to
+	// close, since the DB cannot be used again either way
+	if lockErr := db.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
 }
 
-func (db *DB) Close() error {
+// closeFiles closes every file of the DB, carrying on past a file that fails
+// to close, and returns the errors joined
+func (db *DB) closeFiles() error {
+	var errs []error
 	for _, df := range db.immutableDataFiles {
-		if err := df.Close(); err != nil {
-			return err
-		}
+		errs = append(errs, df.Close())
 	}
-
-	err := db.activeDataFile.Close()
-	if err != nil {
-		return err
+	for _, df := range db.obsoleteFiles {
+		errs = append(errs, df.Close())
+	}
+	for _, bf := range db.blobFiles {
+		errs = append(errs, bf.Close())
+	}
+	if db.activeBlobFile != nil {
+		errs = append(errs, db.activeBlobFile.Close())
 	}
-	return syscall.Flock(int(db.instanceFD), syscall.LOCK_UN)
+	if db.activeDataFile != nil {
+		errs = append(errs, db.activeDataFile.Close())
+	}
+	return errors.Join(errs...)
 }
 
 func (db *DB) loadDB() error {
 	/*
-		Load the DB from the datafiles/mergefiles and hintfiles
+		Load the DB from the datafiles/mergefiles and hintfiles.
+		Merged datafiles only hold entries older than every remaining datafile,
+		so they are loaded first and the datafiles are replayed on top of them.
 	*/
 	// find all datafiles in path by globbing
-	filenames, err := filepath.Glob(fmt.Sprintf("%s/*%s*", db.path, DATAFILE_SUFFIX))
-	sort.Strings(filenames)
+	filenames, err := glob(db.fs, db.path, "*"+DATAFILE_SUFFIX+"*")
 	if err != nil {
 		return err
 	}
-	hintfiles, err := filepath.Glob(fmt.Sprintf("%s/*%s", db.path, HINTFILE_SUFFIX))
+	hintfiles, err := glob(db.fs, db.path, "*"+HINTFILE_SUFFIX)
 	if err != nil {
 		return err
 	}
 	hintfileIDs := ExtractIDsFromFilenames(hintfiles)
-	activeDataFileID := 0
+	// blob files only take part in loading by their ids
+	if err := db.loadBlobFiles(); err != nil {
+		return err
+	}
+
+	var mergedIDs, datafileIDs []int
 	for _, fn := range filenames {
-		// for each datafile, check if it has a hintfile
 		id, err := extractIDFromFilename(fn)
 		if err != nil {
 			continue
 		}
-		opts := []DataFileOptions{AsReadOnly()}
-		if strings.Contains(fn, MERGED_DATAFILE_SUFFIX) {
+		if isMergedDatafile(fn) {
+			mergedIDs = append(mergedIDs, id)
+		} else {
+			datafileIDs = append(datafileIDs, id)
+		}
+	}
+	sort.Ints(mergedIDs)
+	sort.Ints(datafileIDs)
+
+	// the newest plain datafile is the only one a crash can leave a torn
+	// write in, it is cut back to its last complete entry
+	newestID := -1
+	if len(datafileIDs) > 0 {
+		newestID = datafileIDs[len(datafileIDs)-1]
+		if err := db.recoverTornHeader(newestID); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range append(mergedIDs, datafileIDs...) {
+		opts := db.readOnlyOptions()
+		if Contains(id, mergedIDs) {
 			opts = append(opts, AsMergedFile())
 		}
 		df, err := NewDatafile(db.path, id, opts...)
+		if err != nil {
+			return err
+		}
 		db.immutableDataFiles[id] = df
+		if id > db.maxFileId {
+			db.maxFileId = id
+		}
 
 		// if hintfile, load keydir from hintfile
 		if Contains(id, hintfileIDs) {
-			hf, err := NewHintfile(db.path, id)
-			if err != nil {
-				return err
-			}
-			for {
-				hint, hintErr := hf.Read()
-				if hintErr != nil {
-					if hintErr == io.EOF {
-						break
-					} else {
-						return hintErr
-					}
-				}
-				// map hint to keydir entry
-				key, entryItem := hint.produceRecord(id)
-				db.keyDir[key] = entryItem
-			}
-			hf.Close()
+			err = db.loadFromHintfile(df)
 		} else {
 			// read entry from datafile directly
-			if err != nil {
-				return err
-			}
-			var offset uint32
-			for {
-				entry, bytesRead, entryErr := df.Read()
-				if entryErr != nil {
-					if entryErr == io.EOF {
-						break
-					} else {
-						return entryErr
-					}
-				}
-
-				key, entryItem := entry.produceRecord(id, offset, uint32(bytesRead))
-
-				// update index if entry is not a deletion
-				if bytes.Equal(entry.Value, []byte(TOMBSTONE_VALUE)) {
-					delete(db.keyDir, key)
-				} else {
-					// map entry to keydir entry
-					db.keyDir[key] = entryItem
+			err = db.loadFromDatafile(df)
+			var torn *tornWriteError
+			if id == newestID && errors.As(err, &torn) {
+				df, err = db.recoverTornWrite(df, torn)
+				if df == nil {
+					// closed for truncating
+					delete(db.immutableDataFiles, id)
+					return err
 				}
+				db.immutableDataFiles[id] = df
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
 
-				offset += uint32(bytesRead)
+	// the newest plain datafile is reopened as the writable active file,
+	// unless it is in an older format or sealed with an older key, which are
+	// never appended to
+	activeDataFileID := 0
+	if len(filenames) > 0 || len(db.blobFiles) > 0 {
+		activeDataFileID = db.maxFileId + 1
+	}
+	if len(datafileIDs) > 0 {
+		newestID := datafileIDs[len(datafileIDs)-1]
+		if newest := db.immutableDataFiles[newestID]; newest.Version() == CURRENT_FORMAT_VERSION && !db.keys.outdated(newest) {
+			if err := newest.Close(); err != nil {
+				return err
 			}
+			delete(db.immutableDataFiles, newestID)
+			activeDataFileID = newestID
 		}
-		activeDataFileID = id
 	}
-	aDf, aErr := NewDatafile(db.path, activeDataFileID)
+	aDf, aErr := NewDatafile(db.path, activeDataFileID, db.fileOptions()...)
 	if aErr != nil {
 		return aErr
 	}
 	db.activeDataFile = aDf
-	db.maxFileId = activeDataFileID
+	if activeDataFileID > db.maxFileId {
+		db.maxFileId = activeDataFileID
+	}
 	return nil
 }
 
-func (db *DB) put(key, value []byte) error {
-	// check if active file needs rotation
-	if err := db.rotateActiveFile(); err != nil {
-		return err
+// loadFromHintfile loads the keyDir entries of df from its hintfile. The
+// hints are validated before any is applied, if that fails the datafile is
+// scanned instead.
+func (db *DB) loadFromHintfile(df Datafile) error {
+	hints, err := readHints(db.fs, db.path, df, db.keys)
+	if err != nil {
+		log.Warn().Err(err).Str("datafile", df.Name()).
+			Msg("invalid hintfile, scanning the datafile instead")
+		return db.loadFromDatafile(df)
+	}
+	now := db.now()
+	for _, hint := range hints {
+		// map hint to keydir entry
+		key, entryItem := hint.produceRecord(df.ID(), df.Version())
+		if entryItem.isExpired(now) {
+			db.deleteKey(key)
+			db.statsFor(entryItem.fileId).DeadBytes += int64(entryItem.entrySize)
+		} else {
+			db.setKey(key, entryItem)
+		}
 	}
-	entry := NewEntry(key, value)
-	offset_before_write, bytesWritten, err := db.activeDataFile.Write(entry)
+	return nil
+}
+
+// readHints reads every hint of the hintfile of df, checking that they point
+// into df
+func readHints(fsys FS, directory string, df Datafile, k *keyring) ([]Hint, error) {
+	hf, err := openHintfile(fsys, directory, df.ID(), k)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if db.syncOnWrite {
-		err = db.activeDataFile.Sync()
+	defer hf.Close()
+	var hints []Hint
+	for {
+		hint, err := hf.Read()
+		if err == io.EOF {
+			return hints, nil
+		}
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if int64(hint.ValueOffset)+int64(hint.EntrySize(df.Version())) > df.Size() {
+			return nil, ErrCorruptedData
+		}
+		hints = append(hints, hint)
+	}
+}
+
+func (db *DB) loadFromDatafile(df Datafile) error {
+	now := db.now()
+	batches := &batchLoader{db: db, df: df}
+	datafileIterator := df.CreateIterator()
+	for datafileIterator.hasNext() {
+		entry, entryErr := datafileIterator.getNext()
+		if entryErr == nil && !entry.isValid() {
+			entryErr = ErrCorruptedData
+		}
+		if errors.Is(entryErr, ErrDecryptionFailed) {
+			// the checksum matched, so the entry is whole and no torn write
+			batches.discard()
+			return entryErr
+		}
+		if entryErr != nil {
+			batches.discard()
+			return &tornWriteError{offset: int64(entry.Offset), err: entryErr}
+		}
+		if batches.add(entry) {
+			continue
 		}
+		_, entryItem := entry.produceRecord(df.ID(), entry.Offset, entry.EntrySize)
+		db.applyEntry(&entry.Entry, entryItem, now)
 	}
-	K, entryItem := entry.produceRecord(db.activeDataFile.ID(), uint32(offset_before_write), uint32(bytesWritten))
-	db.keyDir[K] = entryItem
+	// a batch still pending at the end of the file was never committed
+	batches.discard()
 	return nil
 }
 
-func (db *DB) rotateActiveFile() error {
-	if db.activeDataFile.Size() < MAX_DATAFILE_SIZE {
+// applyEntry updates the keyDir with an entry written at item; callers must
+// hold mu
+func (db *DB) applyEntry(entry *Entry, item EntryItem, now time.Time) {
+	key := Key(entry.Key)
+	// update index if entry is not a deletion, an expired entry deletes
+	// whatever it overwrote as well
+	if entry.IsTombstone() || entry.IsExpired(now) {
+		db.deleteKey(key)
+		db.statsFor(item.fileId).DeadBytes += int64(item.entrySize)
+	} else if entry.Flags&FLAG_BATCH_COMMIT != 0 {
+		db.statsFor(item.fileId).DeadBytes += int64(item.entrySize)
+	} else {
+		// map entry to keydir entry
+		db.setKey(key, item)
+	}
+}
+
+// put appends an entry to the active file and returns its location, the
+// caller updates the keyDir; callers must hold mu
+func (db *DB) put(entry Entry) (EntryItem, error) {
+	// check if active file needs rotation
+	if err := db.rotateActiveFile(entry.Size()); err != nil {
+		return EntryItem{}, err
+	}
+	return db.appendEntry(entry)
+}
+
+// appendEntry writes entry to the active file, without rotating or syncing.
+// The value is compressed, and goes into the blob log first if it is still
+// over the blob threshold. Callers must hold mu.
+func (db *DB) appendEntry(entry Entry) (EntryItem, error) {
+	if err := db.compressValue(&entry); err != nil {
+		return EntryItem{}, err
+	}
+	if err := db.separateValue(&entry); err != nil {
+		return EntryItem{}, err
+	}
+	offset_before_write, bytesWritten, err := db.activeDataFile.Write(entry)
+	if err != nil {
+		return EntryItem{}, err
+	}
+	db.appended++
+	_, entryItem := entry.produceRecord(db.activeDataFile.ID(), uint64(offset_before_write), uint64(bytesWritten))
+	return entryItem, nil
+}
+
+// rotateActiveFile rotates the active file if appending size more bytes would
+// take it past maxDatafileSize. A file without entries is never rotated, so
+// anything larger than the limit gets a file to itself.
+func (db *DB) rotateActiveFile(size int64) error {
+	current := db.activeDataFile.Size()
+	if current <= FILE_HEADER_SIZE || current+size <= db.maxDatafileSize {
 		return nil
 	}
-	// close activeFile
+	return db.rotate()
+}
+
+// rotate turns the active file into an immutable one and opens a new active
+// file; callers must hold mu
+func (db *DB) rotate() error {
+	defer db.lockReaders()()
+	// close activeFile, which syncs it
 	if err := db.activeDataFile.Close(); err != nil {
-		return err
+		return db.fail(err)
 	}
 	// add activefile to immutable datafiles
 	currID := db.activeDataFile.ID()
-	df, err := NewDatafile(db.path, currID, AsReadOnly())
+	df, err := NewDatafile(db.path, currID, db.readOnlyOptions()...)
 	if err != nil {
 		return err
 	}
@@ -302,7 +878,7 @@ func (db *DB) rotateActiveFile() error {
 	// create new activefile
 	// use max file id + 1
 	newID := db.maxFileId + 1
-	newDf, err := NewDatafile(db.path, newID)
+	newDf, err := NewDatafile(db.path, newID, db.fileOptions()...)
 	if err != nil {
 		return err
 	}
@@ -314,121 +890,49 @@ func (db *DB) rotateActiveFile() error {
 	return nil
 }
 
-func (db *DB) merge1() error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	var mergefile Datafile
-	var hintfile Hintfile
-	var err error
-
-	// get all immutable datafiles
-	for fileId, df := range db.immutableDataFiles {
-
-		datafileIterator := df.CreateIterator()
-		for datafileIterator.hasNext() {
-			entry, _ := datafileIterator.getNext()
-			key := entry.Key
-			entryItem, ok := db.keyDir[Key(key)]
-			if !ok {
-				continue
-			}
-			if !(entryItem.fileId == uint(fileId) && entryItem.entryOffset == entry.Offset) {
-				continue
-			}
-			if mergefile == nil {
-				mergeFileId := db.maxFileId + 1
-				mergefile, err = NewDatafile(db.path, mergeFileId, AsMergedFile())
-				if err != nil {
-					return err
-				}
-				db.maxFileId = mergeFileId
-				hintfile, err = NewHintfile(db.path, mergefile.ID())
-				if err != nil {
-					return err
-				}
-			}
-			// write entry in mergefile
-			offset_before_write, _, err := mergefile.Write(entry.Entry)
-			if err != nil {
-				return err
-			}
-			hint := entry.Entry.toHint()
-			hint.ValueOffset = uint32(offset_before_write)
-			K, newEntryItem := hint.produceRecord(mergefile.ID())
-			db.keyDir[K] = newEntryItem
+// fileOptions are the options every file of the DB is opened with, followed
+// by opts
+func (db *DB) fileOptions(opts ...DataFileOptions) []DataFileOptions {
+	return append([]DataFileOptions{OnFS(db.fs), withKeys(db.keys)}, opts...)
+}
 
-			// write hint in hintfile
-			_, err = hintfile.Write(*hint)
-			if err != nil {
-				return err
-			}
-		}
-		err = df.Close()
-		if err != nil {
-			return err
-		}
-		delete(db.immutableDataFiles, fileId)
-		err = os.Remove(filepath.Join(db.path, df.Name()))
-		if err != nil {
-			return err
-		}
+// readOnlyOptions are the options immutable datafiles are opened with
+func (db *DB) readOnlyOptions() []DataFileOptions {
+	opts := db.fileOptions(AsReadOnly())
+	if db.mmap {
+		opts = append(opts, AsMemoryMapped())
 	}
-
-	return nil
+	return opts
 }
-func (db *DB) merge() error {
-	/*
-		OPTION 1: Going via datafiles
-			To implement merge,
-			- loop through all immutable datafiles
-			- For each record, check that the fileID and offset in df is same as entryItem in keydir
-			- If it is the same, write entry in new merge file and update keydir
-			- After reaching EOF on immutable df, close df and delete df
-			- if merge file exceeds limit, rollover merge file.
-			- merge file rollover also creates a corresponding hint file
-
-		OPTION 2: Going via keydir
-			This approach basically writes out keydir to disk
-			- Open a temporary DB; a merge DB
-			- Use the fold method to iterate over all keys
-			- Read value from db keydir and write to mdb
-	*/
-	return db.merge1()
 
+func (db *DB) validateKey(key Key) error {
+	// validate key length
+	if key.length() == 0 {
+		return ErrKeyZeroLength
+	}
+	if key.length() > db.maxKeySize {
+		return ErrKeyGreaterThanMax
+	}
+	return nil
 }
 
-func open(path string) (*uintptr, error) {
-	fileInfo, err := os.Stat(path)
+// open creates the DB directory if needed and locks it
+func open(fsys FS, path string) (io.Closer, error) {
+	fileInfo, err := fsys.Stat(path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			err = os.Mkdir(path, fs.ModeDir|fs.ModePerm)
+			err = fsys.Mkdir(path, fs.ModeDir|fs.ModePerm)
 			if err != nil {
 				return nil, err
 			}
-			fileInfo, _ = os.Stat(path)
-		} else {
+			fileInfo, err = fsys.Stat(path)
+		}
+		if err != nil {
 			return nil, err
 		}
 	}
 	if !fileInfo.IsDir() {
 		return nil, ErrDBPathNotDir
 	}
-
-	f, fErr := os.Open(path)
-	if fErr != nil {
-		return nil, fErr
-	}
-	fd := f.Fd()
-	lockErr := syscall.Flock(int(fd), syscall.LOCK_EX|syscall.LOCK_NB)
-	if lockErr != nil {
-		if errors.Is(lockErr, syscall.EAGAIN) {
-			lockErr = ErrDBPathInUse
-		}
-		f.Close()
-		return nil, lockErr
-	}
-
-	return &fd, nil
-
+	return fsys.Lock(path)
 }
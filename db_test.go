@@ -1,11 +1,15 @@
 package memorylanedb
 
 import (
+	"context"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	assert2 "github.com/stretchr/testify/assert"
 )
@@ -65,3 +69,324 @@ func TestLoadDB(t *testing.T) {
 	})
 
 }
+
+func TestStats(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	db, err := NewDB(directory, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	first := NewEntry([]byte("foo"), []byte("bar"))
+	second := NewEntry([]byte("foo"), []byte("baz"))
+	other := NewEntry([]byte("qux"), []byte("quux"))
+	tombstone := NewTombstone([]byte("qux"))
+
+	assert.NoError(db.Put("foo", []byte("bar")))
+	assert.NoError(db.Put("foo", []byte("baz")))
+	assert.NoError(db.Put("qux", []byte("quux")))
+	assert.NoError(db.Delete("qux"))
+
+	expected := []DatafileStats{{
+		ID:        0,
+		LiveBytes: second.Size(),
+		DeadBytes: first.Size() + other.Size() + tombstone.Size(),
+	}}
+	assert.Equal(expected, db.Stats()["datafiles"])
+
+	t.Run("RebuiltOnLoad", func(t *testing.T) {
+		assert.NoError(db.Close())
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.Equal(expected, db.Stats()["datafiles"])
+	})
+
+	t.Run("ReclaimedByMerge", func(t *testing.T) {
+		assert.NoError(db.Merge(context.Background()))
+		stats := db.Stats()
+		assert.Equal(second.Size(), stats["liveBytes"])
+		assert.Equal(int64(0), stats["deadBytes"])
+	})
+	assert.NoError(db.Close())
+}
+
+func TestTombstone(t *testing.T) {
+	assert := assert2.New(t)
+
+	t.Run("TombstoneValueIsData", func(t *testing.T) {
+		directory := t.TempDir()
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(db.Put("foo", []byte(TOMBSTONE_VALUE)))
+		assert.NoError(db.Put("bar", []byte("baz")))
+		assert.NoError(db.Delete("bar"))
+		assert.NoError(db.Close())
+
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		value, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte(TOMBSTONE_VALUE), value)
+		_, err = db.Get("bar")
+		assert.ErrorIs(err, ErrKeyNotFound)
+	})
+
+	t.Run("LegacyDatafile", func(t *testing.T) {
+		directory := t.TempDir()
+		legacy := append(encodeLegacyEntry("foo", "bar"), encodeLegacyEntry("baz", "qux")...)
+		legacy = append(legacy, encodeLegacyEntry("baz", TOMBSTONE_VALUE)...)
+		path := filepath.Join(directory, fmt.Sprintf(datafileDefaultName, 0))
+		assert.NoError(os.WriteFile(path, legacy, 0600))
+
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		value, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		_, err = db.Get("baz")
+		assert.ErrorIs(err, ErrKeyNotFound)
+
+		// legacy files are never appended to
+		assert.NoError(db.Put("foo", []byte("new")))
+		assert.NoError(db.Close())
+		data, err := os.ReadFile(path)
+		assert.NoError(err)
+		assert.Equal(legacy, data)
+
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		value, err = db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("new"), value)
+	})
+}
+
+// encodeLegacyEntry encodes an entry in the headerless FORMAT_V0 layout
+func encodeLegacyEntry(key, value string) []byte {
+	buf := make([]byte, CRC_SIZE+TSSTAMP_SIZE+KEY_SIZE+VALUE_SIZE)
+	byteOrder.PutUint32(buf, crc32.ChecksumIEEE([]byte(value)))
+	byteOrder.PutUint32(buf[CRC_SIZE:], uint32(time.Now().Unix()))
+	byteOrder.PutUint16(buf[CRC_SIZE+TSSTAMP_SIZE:], uint16(len(key)))
+	byteOrder.PutUint32(buf[CRC_SIZE+TSSTAMP_SIZE+KEY_SIZE:], uint32(len(value)))
+	return append(append(buf, key...), value...)
+}
+
+func TestTTL(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	db, err := NewDB(directory, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	// write with a clock an hour behind, so the entries are already expired
+	// for the real clock
+	now := time.Now().Add(-time.Hour)
+	db.now = func() time.Time { return now }
+
+	assert.ErrorIs(db.PutWithTTL("foo", []byte("bar"), 0), ErrInvalidTTL)
+	assert.ErrorIs(db.PutWithTTL("foo", []byte("bar"), 100*365*24*time.Hour), ErrInvalidTTL)
+	assert.NoError(db.Put("foo", []byte("old")))
+	assert.NoError(db.PutWithTTL("foo", []byte("bar"), time.Minute))
+	assert.NoError(db.PutWithTTL("baz", []byte("qux"), 2*time.Hour))
+
+	t.Run("Visible", func(t *testing.T) {
+		value, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		ok, _ := db.Has("foo")
+		assert.True(ok)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		// expiry is rounded up to the next second
+		now = now.Add(time.Minute + time.Second)
+		_, err := db.Get("foo")
+		assert.ErrorIs(err, ErrKeyNotFound)
+		ok, _ := db.Has("foo")
+		assert.False(ok)
+		var keys []Key
+		assert.NoError(db.Fold(func(k Key) error {
+			keys = append(keys, k)
+			return nil
+		}))
+		assert.Equal([]Key{"baz"}, keys)
+	})
+
+	t.Run("DroppedOnLoad", func(t *testing.T) {
+		assert.NoError(db.Close())
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		_, err = db.Get("foo")
+		assert.ErrorIs(err, ErrKeyNotFound)
+		value, err := db.Get("baz")
+		assert.NoError(err)
+		assert.Equal([]byte("qux"), value)
+	})
+
+	t.Run("DroppedByMerge", func(t *testing.T) {
+		now = time.Now().Add(2 * time.Hour)
+		db.now = func() time.Time { return now }
+		assert.NoError(db.Merge(context.Background()))
+		assert.Equal(0, db.Stats()["keys"])
+		assert.Equal(int64(0), db.Stats()["liveBytes"])
+	})
+	assert.NoError(db.Close())
+}
+
+func TestScan(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	db, err := NewDB(directory, &Option{MaxValueSize: MAX_VALUE_SIZE, Index: INDEX_BTREE})
+	if !assert.NoError(err) {
+		return
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put(Key(fmt.Sprintf("2023-01-%02d", i)), []byte("bucket")))
+	}
+	assert.NoError(db.Delete("2023-01-03"))
+	collect := func(scan func(start, end Key, f foldFunc) error, start, end Key) []Key {
+		var keys []Key
+		assert.NoError(scan(start, end, func(k Key) error {
+			keys = append(keys, k)
+			return nil
+		}))
+		return keys
+	}
+
+	t.Run("Ascending", func(t *testing.T) {
+		assert.Equal([]Key{"2023-01-02", "2023-01-04"}, collect(db.Scan, "2023-01-02", "2023-01-05"))
+		assert.Len(collect(db.Scan, "", ""), 9)
+	})
+
+	t.Run("Descending", func(t *testing.T) {
+		assert.Equal([]Key{"2023-01-09", "2023-01-08"}, collect(db.ReverseScan, "2023-01-08", ""))
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert.NoError(db.Close())
+		db, err = NewDB(directory, &Option{MaxValueSize: MAX_VALUE_SIZE, Index: INDEX_BTREE})
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		assert.Equal([]Key{"2023-01-00", "2023-01-01"}, collect(db.Scan, "", "2023-01-02"))
+	})
+
+	t.Run("Unordered", func(t *testing.T) {
+		db, err := NewDB(t.TempDir(), nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		assert.ErrorIs(db.Scan("", "", func(Key) error { return nil }), ErrIndexNotOrdered)
+	})
+}
+
+func TestSizeLimits(t *testing.T) {
+	assert := assert2.New(t)
+
+	t.Run("Validation", func(t *testing.T) {
+		_, err := NewDB(t.TempDir(), &Option{MaxKeySize: 1 << 16})
+		assert.ErrorIs(err, ErrInvalidOption)
+		_, err = NewDB(t.TempDir(), &Option{MaxDatafileSize: -1})
+		assert.ErrorIs(err, ErrInvalidOption)
+		_, err = NewDB(t.TempDir(), &Option{MaxMergefileSize: FILE_HEADER_SIZE})
+		assert.ErrorIs(err, ErrInvalidOption)
+		// the largest entry does not have to fit, it gets a file of its own
+		db, err := NewDB(t.TempDir(), &Option{MaxDatafileSize: 1 << 20, MaxMergefileSize: 1 << 20})
+		if assert.NoError(err) {
+			assert.NoError(db.Close())
+		}
+		// offsets are 64-bit, files may grow past 4GB
+		db, err = NewDB(t.TempDir(), &Option{MaxDatafileSize: 1 << 33, MaxMergefileSize: 1 << 33})
+		if assert.NoError(err) {
+			assert.NoError(db.Close())
+		}
+	})
+
+	t.Run("Rollover", func(t *testing.T) {
+		directory := t.TempDir()
+		opts := &Option{MaxKeySize: 16, MaxValueSize: 100, MaxDatafileSize: 512, MaxMergefileSize: 1024}
+		db, err := NewDB(directory, opts)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.ErrorIs(db.Put(Key(strings.Repeat("k", 17)), nil), ErrKeyGreaterThanMax)
+		value := []byte(strings.Repeat("v", 100))
+		for i := 0; i < 50; i++ {
+			assert.NoError(db.Put(Key(fmt.Sprintf("key%02d", i)), value))
+		}
+		for _, st := range db.Stats()["datafiles"].([]DatafileStats) {
+			if df, ok := db.datafile(st.ID); ok {
+				assert.LessOrEqual(df.Size(), opts.MaxDatafileSize)
+			}
+		}
+
+		assert.NoError(db.Merge(context.Background()))
+		merged, _ := filepath.Glob(filepath.Join(directory, "*"+MERGED_DATAFILE_SUFFIX))
+		hints, _ := filepath.Glob(filepath.Join(directory, "*"+HINTFILE_SUFFIX))
+		assert.Greater(len(merged), 1)
+		assert.Len(hints, len(merged))
+		for _, name := range merged {
+			stat, err := os.Stat(name)
+			assert.NoError(err)
+			assert.LessOrEqual(stat.Size(), opts.MaxMergefileSize)
+		}
+
+		assert.NoError(db.Close())
+		db, err = NewDB(directory, opts)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		for i := 0; i < 50; i++ {
+			got, err := db.Get(Key(fmt.Sprintf("key%02d", i)))
+			assert.NoError(err)
+			assert.Equal(value, got)
+		}
+	})
+
+	t.Run("OversizedEntry", func(t *testing.T) {
+		directory := t.TempDir()
+		opts := &Option{MaxValueSize: 2048, MaxDatafileSize: 512, MaxMergefileSize: 512}
+		db, err := NewDB(directory, opts)
+		if !assert.NoError(err) {
+			return
+		}
+		large := []byte(strings.Repeat("v", 2048))
+		assert.NoError(db.Put("small", []byte("value")))
+		assert.NoError(db.Put("large", large))
+		assert.NoError(db.Put("after", []byte("value")))
+		assert.NoError(db.Merge(context.Background()))
+		assert.NoError(db.Close())
+
+		db, err = NewDB(directory, opts)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		got, err := db.Get("large")
+		assert.NoError(err)
+		assert.Equal(large, got)
+		got, err = db.Get("after")
+		assert.NoError(err)
+		assert.Equal([]byte("value"), got)
+	})
+}
@@ -0,0 +1,240 @@
+package memorylanedb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+/*
+	Encryption at rest: every datafile, blob file and hintfile records in its
+	header the id of the key its entries are encrypted with, 0 if they are
+	not, a check value of that key, and whether their keys are encrypted as
+	well. Files are written with the newest key of Option.EncryptionKeys and
+	read with whichever key their header names, so keys are rotated by adding
+	a newer one; a merge rewrites the live entries, and the blob files holding
+	live values, with it. The check value rejects a file opened with another
+	key under the same id before any of its entries is read.
+
+	A value that fails to decrypt reports ErrDecryptionFailed, never
+	ErrCorruptedData: its checksum matched, so it is whole, and recovery must
+	not mistake it for a torn write.
+
+	Sealing is done by the codec of a file. A value is stored as a random
+	nonce followed by its AES-GCM ciphertext, authenticated together with the
+	key of the entry. An encrypted key is stored the same way. The size fields
+	and the checksum of an entry describe the sealed bytes on disk, decoded
+	entries hold the plaintext again.
+*/
+
+const (
+	NONCE_SIZE = 12
+	TAG_SIZE   = 16
+	// SEAL_OVERHEAD is what sealing adds to the size of a key or value
+	SEAL_OVERHEAD = NONCE_SIZE + TAG_SIZE
+
+	KEY_ID_SIZE       = 4
+	KEY_CHECK_SIZE    = 8
+	HEADER_FLAGS_SIZE = 1
+)
+
+// keyCheckMessage is what the check value of a key is the MAC of
+var keyCheckMessage = []byte("memorylanedb key check")
+
+// file header flags
+const (
+	// HEADER_SEALED_KEYS marks a file whose entry keys are encrypted
+	HEADER_SEALED_KEYS uint8 = 1 << iota
+)
+
+// keyring holds the encryption keys of a DB by id, the highest id is the one
+// new files are written with
+type keyring struct {
+	aeads    map[uint32]cipher.AEAD
+	checks   map[uint32][]byte
+	current  uint32
+	sealKeys bool
+}
+
+func newKeyring(keys map[uint32][]byte, sealKeys bool) (*keyring, error) {
+	if len(keys) == 0 {
+		if sealKeys {
+			return nil, fmt.Errorf("%w: EncryptKeys needs EncryptionKeys", ErrInvalidOption)
+		}
+		return nil, nil
+	}
+	k := &keyring{
+		aeads:    make(map[uint32]cipher.AEAD, len(keys)),
+		checks:   make(map[uint32][]byte, len(keys)),
+		sealKeys: sealKeys,
+	}
+	for id, key := range keys {
+		if id == 0 {
+			return nil, fmt.Errorf("%w: encryption key id 0 is reserved for unencrypted files", ErrInvalidOption)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: encryption key %d: %v", ErrInvalidOption, id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[id] = aead
+		k.checks[id] = keyCheck(key)
+		if id > k.current {
+			k.current = id
+		}
+	}
+	return k, nil
+}
+
+// sealing returns how new files are sealed, nil if they are not
+func (k *keyring) sealing() *sealing {
+	if k == nil {
+		return nil
+	}
+	return &sealing{keyID: k.current, aead: k.aeads[k.current], check: k.checks[k.current], keys: k.sealKeys}
+}
+
+// keyCheck returns the check value of key that file headers record. It is a
+// MAC rather than the encryption of a known block, which for AES-GCM would
+// give away the authentication key.
+func keyCheck(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(keyCheckMessage)
+	return mac.Sum(nil)[:KEY_CHECK_SIZE]
+}
+
+// open returns the sealing of a file from its header, failing with
+// ErrDecryptionFailed if the key of keyID is not the one the file was written
+// with
+func (k *keyring) open(keyID uint32, check []byte, flags uint8) (*sealing, error) {
+	if keyID == 0 {
+		return nil, nil
+	}
+	if k == nil {
+		return nil, ErrUnknownEncryptionKey
+	}
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return nil, ErrUnknownEncryptionKey
+	}
+	if !hmac.Equal(check, k.checks[keyID]) {
+		return nil, fmt.Errorf("%w: key %d is not the one the file was written with", ErrDecryptionFailed, keyID)
+	}
+	return &sealing{keyID: keyID, aead: aead, check: k.checks[keyID], keys: flags&HEADER_SEALED_KEYS != 0}, nil
+}
+
+// outdated reports whether df is not sealed the way new files are
+func (k *keyring) outdated(df Datafile) bool {
+	s := k.sealing()
+	if s == nil {
+		return df.KeyID() != 0
+	}
+	return df.KeyID() != s.keyID || df.EncryptsKeys() != s.keys
+}
+
+// sealing encrypts and decrypts the entries of one file
+type sealing struct {
+	keyID uint32
+	aead  cipher.AEAD
+	check []byte // check value of the key, see keyCheck
+	keys  bool   // keys are sealed as well as values
+}
+
+func (s *sealing) headerFlags() uint8 {
+	if s.keys {
+		return HEADER_SEALED_KEYS
+	}
+	return 0
+}
+
+func (s *sealing) seal(plaintext, ad []byte) []byte {
+	buf := make([]byte, NONCE_SIZE, NONCE_SIZE+len(plaintext)+TAG_SIZE)
+	if _, err := rand.Read(buf); err != nil {
+		// crypto/rand does not fail on the platforms we support
+		panic(err)
+	}
+	return s.aead.Seal(buf, buf, plaintext, ad)
+}
+
+func (s *sealing) open(sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < SEAL_OVERHEAD {
+		return nil, ErrCorruptedData
+	}
+	plaintext := make([]byte, 0, len(sealed)-SEAL_OVERHEAD)
+	plaintext, err := s.aead.Open(plaintext, sealed[:NONCE_SIZE], sealed[NONCE_SIZE:], ad)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+// sealEntry returns entry as it is stored
+func (s *sealing) sealEntry(entry *Entry) Entry {
+	stored := *entry
+	if s.keys {
+		stored.Key = s.seal(entry.Key, nil)
+		stored.KeySize = uint16(len(stored.Key))
+	}
+	stored.Value = s.seal(entry.Value, entry.Key)
+	stored.ValueSize = uint32(len(stored.Value))
+	return stored
+}
+
+// openEntry decrypts a stored entry in place
+func (s *sealing) openEntry(entry *Entry) error {
+	if s.keys {
+		key, err := s.open(entry.Key, nil)
+		if err != nil {
+			return err
+		}
+		entry.Key = key
+		entry.KeySize = uint16(len(key))
+	}
+	value, err := s.open(entry.Value, entry.Key)
+	if err != nil {
+		return err
+	}
+	entry.Value = value
+	entry.ValueSize = uint32(len(value))
+	return nil
+}
+
+// sealHint returns hint as it is stored, its sizes are those of the sealed
+// entry it points to
+func (s *sealing) sealHint(hint *Hint) Hint {
+	stored := *hint
+	if s.keys {
+		stored.Key = s.seal(hint.Key, nil)
+		stored.KeySize = uint16(len(stored.Key))
+	}
+	stored.ValueSize += SEAL_OVERHEAD
+	return stored
+}
+
+// openHint decrypts the key of a stored hint, its sizes stay those of the
+// sealed entry
+func (s *sealing) openHint(hint *Hint) error {
+	if !s.keys {
+		return nil
+	}
+	key, err := s.open(hint.Key, nil)
+	if err != nil {
+		return err
+	}
+	hint.Key = key
+	return nil
+}
+
+// withKeys lets a datafile open files sealed with the keys of k and seal the
+// files it creates with its newest key
+func withKeys(k *keyring) DataFileOptions {
+	return func(df *datafile) {
+		df.keys = k
+	}
+}
@@ -0,0 +1,245 @@
+package memorylanedb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestEncryption(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 16)
+	open := func(keys map[uint32][]byte) *DB {
+		db, err := NewDB(directory, &Option{EncryptionKeys: keys, EncryptKeys: len(keys) > 0, BlobThreshold: 256})
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		return db
+	}
+	value := func(i int) []byte {
+		if i%5 == 0 {
+			// goes into the blob log
+			return []byte(strings.Repeat(fmt.Sprintf("secret-value-%d;", i), 40))
+		}
+		return []byte(fmt.Sprintf("secret-value-%d", i))
+	}
+	check := func(db *DB) {
+		for i := 0; i < 50; i++ {
+			got, err := db.Get(Key(fmt.Sprintf("secret-key-%d", i)))
+			assert.NoError(err)
+			assert.Equal(value(i), got)
+		}
+	}
+	// keyIDs collects the key ids of every open file
+	keyIDs := func(db *DB) map[uint32]int {
+		ids := make(map[uint32]int)
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		files := append([]Datafile{db.activeDataFile}, db.immutableBlobFiles()...)
+		for _, df := range db.immutableDataFiles {
+			files = append(files, df)
+		}
+		for _, df := range files {
+			ids[df.KeyID()]++
+		}
+		return ids
+	}
+	// plaintext reports the files of the directory that contain "secret"
+	plaintext := func() []string {
+		var found []string
+		filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if bytes.Contains(data, []byte("secret")) {
+				found = append(found, filepath.Base(path))
+			}
+			return nil
+		})
+		return found
+	}
+
+	db := open(nil)
+	for i := 0; i < 50; i++ {
+		assert.NoError(db.Put(Key(fmt.Sprintf("secret-key-%d", i)), value(i)))
+	}
+	assert.NoError(db.Close())
+
+	t.Run("EncryptsExistingFiles", func(t *testing.T) {
+		db = open(map[uint32][]byte{1: key1})
+		check(db)
+		assert.NotEmpty(plaintext())
+		assert.NoError(db.Merge(context.Background()))
+		check(db)
+		assert.Equal(map[uint32]int{1: keyIDs(db)[1]}, keyIDs(db))
+		assert.Empty(plaintext())
+	})
+
+	t.Run("NoPlaintextOnDisk", func(t *testing.T) {
+		for i := 0; i < 50; i += 2 {
+			assert.NoError(db.Put(Key(fmt.Sprintf("secret-key-%d", i)), value(i)))
+		}
+		assert.NoError(db.PutReader("secret-key-streamed", bytes.NewReader(value(0)), int64(len(value(0)))))
+		assert.NoError(db.Delete("secret-key-streamed"))
+		check(db)
+		assert.Empty(plaintext())
+
+		for _, i := range []int{3, 5} {
+			r, err := db.GetReader(Key(fmt.Sprintf("secret-key-%d", i)))
+			if !assert.NoError(err) {
+				return
+			}
+			streamed, err := io.ReadAll(r)
+			assert.NoError(err)
+			assert.Equal(value(i), streamed)
+			assert.NoError(r.Close())
+		}
+	})
+
+	t.Run("KeyRotation", func(t *testing.T) {
+		assert.NoError(db.Close())
+		db = open(map[uint32][]byte{1: key1, 2: key2})
+		check(db)
+		for i := 1; i < 50; i += 2 {
+			assert.NoError(db.Put(Key(fmt.Sprintf("secret-key-%d", i)), value(i)))
+		}
+		check(db)
+		ids := keyIDs(db)
+		assert.Greater(ids[1], 0)
+		assert.Greater(ids[2], 0)
+
+		assert.NoError(db.Merge(context.Background()))
+		check(db)
+		assert.Equal(0, keyIDs(db)[1])
+		assert.Empty(plaintext())
+
+		// the old key is no longer needed
+		assert.NoError(db.Close())
+		db = open(map[uint32][]byte{2: key2})
+		check(db)
+		assert.NoError(db.Close())
+	})
+
+	t.Run("UnknownKey", func(t *testing.T) {
+		_, err := NewDB(directory, nil)
+		assert.ErrorIs(err, ErrUnknownEncryptionKey)
+		_, err = NewDB(directory, &Option{EncryptionKeys: map[uint32][]byte{1: key1}})
+		assert.ErrorIs(err, ErrUnknownEncryptionKey)
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		sizes := func() map[string]int64 {
+			sizes := make(map[string]int64)
+			entries, err := os.ReadDir(directory)
+			assert.NoError(err)
+			for _, e := range entries {
+				if info, err := e.Info(); err == nil && !info.IsDir() {
+					sizes[e.Name()] = info.Size()
+				}
+			}
+			return sizes
+		}
+		before := sizes()
+		// the files name key 2, but it is another one
+		_, err := NewDB(directory, &Option{EncryptionKeys: map[uint32][]byte{2: key1}})
+		assert.ErrorIs(err, ErrDecryptionFailed)
+		assert.Equal(before, sizes())
+
+		db = open(map[uint32][]byte{2: key2})
+		check(db)
+		assert.NoError(db.Close())
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		for _, opts := range []*Option{
+			{EncryptionKeys: map[uint32][]byte{1: []byte("short")}},
+			{EncryptionKeys: map[uint32][]byte{0: key1}},
+			{EncryptKeys: true},
+			{EncryptionKeys: map[uint32][]byte{1: key1}, EncryptKeys: true, MaxKeySize: math.MaxUint16},
+		} {
+			_, err := NewDB(t.TempDir(), opts)
+			assert.ErrorIs(err, ErrInvalidOption)
+		}
+	})
+}
+
+// stagingFS records everything written to files of the staging directory
+type stagingFS struct {
+	FS
+	mu      sync.Mutex
+	written map[string][]byte
+}
+
+func (s *stagingFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := s.FS.OpenFile(name, flag, perm)
+	if err != nil || !strings.Contains(name, STAGING_DIRNAME) {
+		return f, err
+	}
+	return &stagingFile{File: f, fs: s, name: name}, nil
+}
+
+func (s *stagingFS) record(name string, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written[name] = append(s.written[name], p...)
+}
+
+type stagingFile struct {
+	File
+	fs   *stagingFS
+	name string
+}
+
+func (f *stagingFile) Write(p []byte) (int, error) {
+	f.fs.record(f.name, p)
+	return f.File.Write(p)
+}
+
+func (f *stagingFile) WriteAt(p []byte, offset int64) (int, error) {
+	f.fs.record(f.name, p)
+	return f.File.WriteAt(p, offset)
+}
+
+func TestEncryptedStaging(t *testing.T) {
+	assert := assert2.New(t)
+	fsys := &stagingFS{FS: NewMemFS(), written: make(map[string][]byte)}
+	db, err := NewDB("/db", &Option{
+		FS:             fsys,
+		EncryptionKeys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)},
+		BlobThreshold:  256,
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+
+	// one value goes into the active datafile, the other into a blob file
+	for _, size := range []int{100, 1000} {
+		value := []byte(strings.Repeat("plaintext", size)[:size])
+		key := Key(fmt.Sprintf("key%d", size))
+		assert.NoError(db.PutReader(key, bytes.NewReader(value), int64(size)))
+		got, err := db.Get(key)
+		assert.NoError(err)
+		assert.Equal(value, got)
+	}
+	for name, written := range fsys.written {
+		assert.False(bytes.Contains(written, []byte("plaintext")), name)
+	}
+}
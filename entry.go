@@ -1,21 +1,39 @@
 package memorylanedb
 
-import (
-	"hash/crc32"
-	"time"
-)
+import "time"
 
 const (
 	// In bytes
 	CRC_SIZE     = 4
 	TSSTAMP_SIZE = 4
+	EXPIRY_SIZE  = 4
+	FLAGS_SIZE   = 1
 	KEY_SIZE     = 2
 	VALUE_SIZE   = 4
 )
 
+// entry flags
+const (
+	FLAG_TOMBSTONE uint8 = 1 << iota
+	// FLAG_BATCH marks an entry of a WriteBatch, it only counts once the
+	// FLAG_BATCH_COMMIT entry that follows the batch is on disk
+	FLAG_BATCH
+	FLAG_BATCH_COMMIT
+	// FLAG_BLOB marks an entry whose value is a pointer into a blob file
+	FLAG_BLOB
+
+	// COMPRESSOR_FLAGS hold the id of the Compressor of the value
+	COMPRESSOR_FLAGS uint8 = 0x70
+	COMPRESSOR_SHIFT       = 4
+
+	KNOWN_FLAGS = FLAG_TOMBSTONE | FLAG_BATCH | FLAG_BATCH_COMMIT | FLAG_BLOB | COMPRESSOR_FLAGS
+)
+
 type Entry struct {
-	Checksum  uint32
+	Checksum  uint32 // computed by the codec when the entry is encoded
 	Tstamp    uint32
+	Expiry    uint32 // unix time after which the entry is gone, 0 never expires
+	Flags     uint8
 	KeySize   uint16
 	ValueSize uint32 // size of value in bytes
 	Key       []byte
@@ -24,7 +42,6 @@ type Entry struct {
 
 func NewEntry(key, value []byte) Entry {
 	return Entry{
-		Checksum:  crc32.ChecksumIEEE(value),
 		Tstamp:    uint32(time.Now().Unix()),
 		KeySize:   uint16(len(key)),
 		ValueSize: uint32(len(value)),
@@ -33,19 +50,50 @@ func NewEntry(key, value []byte) Entry {
 	}
 }
 
+// NewTombstone returns the entry that marks key as deleted
+func NewTombstone(key []byte) Entry {
+	entry := NewEntry(key, nil)
+	entry.Flags = FLAG_TOMBSTONE
+	return entry
+}
+
+func (e *Entry) IsTombstone() bool {
+	return e.Flags&FLAG_TOMBSTONE != 0
+}
+
+func (e *Entry) IsBlobPointer() bool {
+	return e.Flags&FLAG_BLOB != 0
+}
+
+// IsExpired reports whether the entry had an expiry that is before now
+func (e *Entry) IsExpired(now time.Time) bool {
+	return isExpired(e.Expiry, now)
+}
+
+func isExpired(expiry uint32, now time.Time) bool {
+	return expiry != 0 && int64(expiry) <= now.Unix()
+}
+
+// isValid reports whether a decoded entry has a key, only batch commit entries
+// have none. The codec already verified its checksum.
+func (e *Entry) isValid() bool {
+	return len(e.Key) != 0 || e.Flags&FLAG_BATCH_COMMIT != 0
+}
+
 func (e *Entry) HeaderSize() int64 {
-	return CRC_SIZE + TSSTAMP_SIZE + KEY_SIZE + VALUE_SIZE
+	return entryHeaderSize(CURRENT_FORMAT_VERSION)
 }
 
 func (e *Entry) Size() int64 {
 	return e.HeaderSize() + int64(len(e.Key)+len(e.Value))
 }
 
-func (e *Entry) produceRecord(id int, offset, size uint32) (Key, EntryItem) {
+func (e *Entry) produceRecord(id int, offset, size uint64) (Key, EntryItem) {
 	key := Key(e.Key)
 	entryItem := EntryItem{
 		fileId:      uint(id),
 		tstamp:      e.Tstamp,
+		expiry:      e.Expiry,
 		entrySize:   size,
 		entryOffset: offset,
 	}
@@ -55,6 +103,7 @@ func (e *Entry) produceRecord(id int, offset, size uint32) (Key, EntryItem) {
 func (e *Entry) toHint() *Hint {
 	return &Hint{
 		Tstamp:    e.Tstamp,
+		Expiry:    e.Expiry,
 		KeySize:   e.KeySize,
 		ValueSize: e.ValueSize,
 		Key:       e.Key,
@@ -5,18 +5,39 @@ import "errors"
 var (
 	ErrWriterNotExposed = errors.New("can not write for the datafile")
 
-	ErrDBPathNotDir = errors.New("database path is not a directory")
-	ErrDBPathInUse  = errors.New("database path is in use by another process")
+	ErrDBPathNotDir  = errors.New("database path is not a directory")
+	ErrDBPathInUse   = errors.New("database path is in use by another process")
+	ErrInvalidOption = errors.New("invalid option")
+	ErrDBClosed      = errors.New("database is closed")
 
 	ErrKeyZeroLength       = errors.New("zero key length")
 	ErrKeyGreaterThanMax   = errors.New("key size is greater than configured threshold")
 	ErrValueGreaterThanMax = errors.New("value size is greater than configured threshold")
+	ErrInvalidTTL          = errors.New("ttl must be positive and end before 2106")
 
-	ErrKeyNotFound = errors.New("key not found")
+	ErrKeyNotFound     = errors.New("key not found")
+	ErrIndexNotOrdered = errors.New("range scans need an ordered index")
 
-	ErrCorruptedData    = errors.New("value failed checksum check")
-	ErrReadOnlyDataFile = errors.New("datafile is readonly")
+	ErrMergeInProgress = errors.New("a merge is already in progress")
 
+	ErrTxnConflict = errors.New("transaction conflicts with a concurrent write")
+	ErrTxnDone     = errors.New("transaction has already been committed or rolled back")
+
+	ErrSnapshotClosed = errors.New("snapshot is closed")
+	ErrIteratorClosed = errors.New("iterator is closed")
+	ErrReaderClosed   = errors.New("value reader is closed")
+
+	ErrCorruptedData        = errors.New("entry failed checksum check")
+	ErrUnknownEntryFlags    = errors.New("entry has unknown flags set")
+	ErrUnknownCompressor    = errors.New("entry is compressed by an unknown compressor")
+	ErrUnknownEncryptionKey = errors.New("file is encrypted with an unknown key")
+	ErrDecryptionFailed     = errors.New("entry failed to decrypt, the key is wrong or the data was tampered with")
+	ErrUnsupportedVersion   = errors.New("unsupported file format version")
+	ErrInvalidFileHeader    = errors.New("file is not a memorylanedb file of the expected kind")
+	ErrReadOnlyDataFile     = errors.New("datafile is readonly")
+
+	ErrWritingHeader = errors.New("error writing file header")
+	ErrWritingFooter = errors.New("error writing file footer")
 	ErrWritingPrefix = errors.New("error writing entry prefix")
 	ErrWritingKey    = errors.New("error writing key")
 	ErrWritingValue  = errors.New("error writing value")
@@ -0,0 +1,316 @@
+package memorylanedb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+// faultFS wraps an FS and fails its writes and syncs on demand
+type faultFS struct {
+	FS
+	mu        sync.Mutex
+	writeLeft int64 // bytes that can still be written, negative is unlimited
+	syncErr   error
+	open      int // files opened and not closed yet
+}
+
+func newFaultFS(fsys FS) *faultFS {
+	return &faultFS{FS: fsys, writeLeft: -1}
+}
+
+// limitWrites lets n more bytes be written, the write that crosses the limit
+// is short and every write fails with ENOSPC from then on. A negative n lifts
+// the limit.
+func (f *faultFS) limitWrites(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writeLeft = n
+}
+
+// failSyncs makes every sync return err, nil lets them succeed again
+func (f *faultFS) failSyncs(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.syncErr = err
+}
+
+// allow returns how many of n bytes may be written
+func (f *faultFS) allow(n int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.writeLeft < 0 {
+		return n
+	}
+	if int64(n) > f.writeLeft {
+		n = int(f.writeLeft)
+	}
+	f.writeLeft -= int64(n)
+	return n
+}
+
+func (f *faultFS) syncError() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.syncErr
+}
+
+// openFiles returns how many files are open
+func (f *faultFS) openFiles() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.open
+}
+
+func (f *faultFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	file, err := f.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.open++
+	f.mu.Unlock()
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *faultFS) SyncDir(dir string) error {
+	if err := f.syncError(); err != nil {
+		return err
+	}
+	return f.FS.SyncDir(dir)
+}
+
+type faultFile struct {
+	File
+	fs *faultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	allowed := f.fs.allow(len(p))
+	n, err := f.File.Write(p[:allowed])
+	if err == nil && allowed < len(p) {
+		err = syscall.ENOSPC
+	}
+	return n, err
+}
+
+func (f *faultFile) WriteAt(p []byte, offset int64) (int, error) {
+	allowed := f.fs.allow(len(p))
+	n, err := f.File.WriteAt(p[:allowed], offset)
+	if err == nil && allowed < len(p) {
+		err = syscall.ENOSPC
+	}
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.syncError(); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Close() error {
+	err := f.File.Close()
+	if err == nil {
+		f.fs.mu.Lock()
+		f.fs.open--
+		f.fs.mu.Unlock()
+	}
+	return err
+}
+
+func TestMemFS(t *testing.T) {
+	assert := assert2.New(t)
+
+	t.Run("Files", func(t *testing.T) {
+		fsys := NewMemFS()
+		assert.NoError(fsys.MkdirAll("/a/b", 0700))
+		f, err := fsys.OpenFile("/a/b/file", os.O_RDWR|os.O_CREATE, 0600)
+		if !assert.NoError(err) {
+			return
+		}
+		_, err = f.Write([]byte("hello world"))
+		assert.NoError(err)
+		assert.NoError(f.Truncate(5))
+
+		// an open file survives a rename and a remove
+		assert.NoError(fsys.Rename("/a/b/file", "/a/file"))
+		names, err := fsys.List("/a")
+		assert.NoError(err)
+		assert.Equal([]string{"b", "file"}, names)
+		assert.NoError(fsys.Remove("/a/file"))
+		buf := make([]byte, 10)
+		n, err := f.ReadAt(buf, 0)
+		assert.Equal(io.EOF, err)
+		assert.Equal("hello", string(buf[:n]))
+		assert.NoError(f.Close())
+
+		_, err = fsys.Stat("/a/file")
+		assert.ErrorIs(err, os.ErrNotExist)
+		_, err = fsys.OpenFile("/missing/file", os.O_RDWR|os.O_CREATE, 0600)
+		assert.ErrorIs(err, os.ErrNotExist)
+		assert.NoError(fsys.RemoveAll("/a"))
+		_, err = fsys.List("/a")
+		assert.ErrorIs(err, os.ErrNotExist)
+	})
+
+	t.Run("Database", func(t *testing.T) {
+		fsys := NewMemFS()
+		opts := &Option{FS: fsys, MaxDatafileSize: 8 << 10, BlobThreshold: 512, MaxValueSize: 4 << 10}
+		db, err := NewDB("/db", opts)
+		if !assert.NoError(err) {
+			return
+		}
+		value := func(i int) []byte {
+			return []byte(fmt.Sprintf("%0*d", 10+i*10, i))
+		}
+		for i := 0; i < 100; i++ {
+			assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), value(i)))
+		}
+		for i := 0; i < 100; i += 3 {
+			assert.NoError(db.Delete(Key(fmt.Sprintf("key%d", i))))
+		}
+		assert.NoError(db.Merge(context.Background()))
+
+		_, err = NewDB("/db", opts)
+		assert.ErrorIs(err, ErrDBPathInUse)
+		assert.NoError(db.Close())
+		// nothing went to disk
+		_, err = os.Stat("/db")
+		assert.ErrorIs(err, os.ErrNotExist)
+
+		db, err = NewDB("/db", opts)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		for i := 0; i < 100; i++ {
+			got, err := db.Get(Key(fmt.Sprintf("key%d", i)))
+			if i%3 == 0 {
+				assert.ErrorIs(err, ErrKeyNotFound)
+			} else {
+				assert.NoError(err)
+				assert.Equal(value(i), got)
+			}
+		}
+		hintfiles, err := glob(fsys, "/db", "*"+HINTFILE_SUFFIX)
+		assert.NoError(err)
+		assert.NotEmpty(hintfiles)
+	})
+}
+
+func TestFaults(t *testing.T) {
+	assert := assert2.New(t)
+	fsys := newFaultFS(NewMemFS())
+	opts := &Option{FS: fsys, SyncMode: SYNC_ALWAYS}
+	db, err := NewDB("db", opts)
+	if !assert.NoError(err) {
+		return
+	}
+	defer func() { db.Close() }()
+
+	check := func(n int) {
+		for i := 0; i < n; i++ {
+			got, err := db.Get(Key(fmt.Sprintf("key%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("value%d", i)), got)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+	}
+
+	t.Run("NoSpace", func(t *testing.T) {
+		fsys.limitWrites(10)
+		err := db.Put("failed", []byte("value"))
+		assert.ErrorIs(err, syscall.ENOSPC)
+		_, err = db.Get("failed")
+		assert.ErrorIs(err, ErrKeyNotFound)
+
+		// the short write was cut off, writes continue right after the last
+		// complete entry
+		fsys.limitWrites(-1)
+		for i := 10; i < 20; i++ {
+			assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+		}
+		check(20)
+	})
+
+	t.Run("SyncError", func(t *testing.T) {
+		errSync := errors.New("fsync failed")
+		fsys.failSyncs(errSync)
+		assert.ErrorIs(db.Put("key0", []byte("value0")), errSync)
+		assert.ErrorIs(db.Sync(), errSync)
+
+		// a sync that succeeds later proves nothing about the failed writes,
+		// the DB stays read-only
+		fsys.failSyncs(nil)
+		assert.ErrorIs(db.Sync(), errSync)
+		assert.ErrorIs(db.Put("key20", []byte("value20")), errSync)
+		assert.ErrorIs(db.Delete("key1"), errSync)
+		assert.ErrorIs(db.Merge(context.Background()), errSync)
+		check(20)
+
+		assert.NoError(db.Close())
+		db, err = NewDB("db", opts)
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		assert.NoError(db.Put("key20", []byte("value20")))
+		assert.NoError(db.Delete("key20"))
+	})
+
+	t.Run("MergeFailure", func(t *testing.T) {
+		fsys.limitWrites(100)
+		assert.ErrorIs(db.Merge(context.Background()), syscall.ENOSPC)
+		fsys.limitWrites(-1)
+		check(20)
+		_, err := fsys.Stat("db/" + MERGE_DIRNAME)
+		assert.ErrorIs(err, os.ErrNotExist)
+
+		assert.NoError(db.Merge(context.Background()))
+		check(20)
+	})
+
+	t.Run("CloseError", func(t *testing.T) {
+		// spread the keys over several files, each of which fails to sync
+		for i := 0; i < 3; i++ {
+			db.mu.Lock()
+			assert.NoError(db.rotate())
+			db.mu.Unlock()
+			assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+		}
+		errSync := errors.New("fsync failed")
+		fsys.failSyncs(errSync)
+		assert.ErrorIs(db.Close(), errSync)
+		// every file was closed and the directory released all the same
+		assert.Equal(0, fsys.openFiles())
+
+		fsys.failSyncs(nil)
+		db, err = NewDB("db", opts)
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		check(20)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert.NoError(db.Close())
+		db, err = NewDB("db", opts)
+		if !assert.NoError(err) {
+			return
+		}
+		check(20)
+		_, err = db.Get("failed")
+		assert.ErrorIs(err, ErrKeyNotFound)
+	})
+}
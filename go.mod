@@ -1,6 +1,6 @@
 module github.com/sarkk0x0/memorylanedb
 
-go 1.18
+go 1.20
 
 require (
 	github.com/rs/zerolog v1.29.0
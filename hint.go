@@ -2,32 +2,44 @@ package memorylanedb
 
 const (
 	// In bytes
-	VALUE_OFFSET_SIZE = 4
+	VALUE_OFFSET_SIZE      = 4
+	WIDE_VALUE_OFFSET_SIZE = 8 // FORMAT_V5 and later
 )
 
+// Hint locates a datafile entry. KeySize and ValueSize are the sizes the key
+// and value take in the datafile, a decoded hint of an encrypted file holds
+// the decrypted key but the sizes of the sealed entry.
 type Hint struct {
 	Tstamp      uint32
+	Expiry      uint32
 	KeySize     uint16
 	ValueSize   uint32
-	ValueOffset uint32 // offset of the entry in the datafile
+	ValueOffset uint64 // offset of the entry in the datafile
 	Key         []byte
 }
 
 func (h *Hint) HeaderSize() int64 {
-	return TSSTAMP_SIZE + KEY_SIZE + VALUE_SIZE + VALUE_OFFSET_SIZE
+	return formats[CURRENT_FORMAT_VERSION].hintHeaderSize()
 }
 
 func (h *Hint) Size() int64 {
 	return h.HeaderSize() + int64(len(h.Key))
 }
 
-func (h *Hint) produceRecord(id int) (Key, EntryItem) {
+// EntrySize is the size of the datafile entry the hint points to, given the
+// format version of that datafile
+func (h *Hint) EntrySize(version uint16) uint64 {
+	return uint64(entryHeaderSize(version)) + uint64(h.KeySize) + uint64(h.ValueSize)
+}
+
+func (h *Hint) produceRecord(id int, version uint16) (Key, EntryItem) {
 	key := Key(h.Key)
 	entryItem := EntryItem{
 		fileId:      uint(id),
-		entrySize:   h.ValueSize,
+		entrySize:   h.EntrySize(version),
 		entryOffset: h.ValueOffset,
 		tstamp:      h.Tstamp,
+		expiry:      h.Expiry,
 	}
 	return key, entryItem
 }
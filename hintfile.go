@@ -2,6 +2,7 @@ package memorylanedb
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 )
@@ -12,23 +13,37 @@ type Hintfile interface {
 	ID() int
 	Name() string
 	Write(hint Hint) (int64, error)
+	// Finish writes the footer that marks the hintfile as complete, no hint
+	// can be written after it
+	Finish() error
 	Read() (Hint, error)
+	Version() uint16
+	Sync() error
 	Close() error
 }
 
 // generated after merge and compaction
 type hintfile struct {
-	id    int
-	name  string
-	file  *os.File
-	codec *Codec
+	id     int
+	name   string
+	file   File
+	codec  *Codec
+	count  uint32 // hints written, or held according to the footer
+	read   uint32 // hints read so far
+	offset int64  // read offset, to check the hints end at the footer
+	size   int64
 }
 
 func NewHintfile(directory string, id int) (Hintfile, error) {
-	// opens a hintfile
+	return openHintfile(OSFS, directory, id, nil)
+}
+
+// openHintfile opens a hintfile on fsys that is sealed with the keys of k, or
+// that is created sealed with its newest key
+func openHintfile(fsys FS, directory string, id int, k *keyring) (Hintfile, error) {
 	name := fmt.Sprintf(hintfileDefaultName, id)
 	path := filepath.Join(directory, name)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	f, err := fsys.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
 		return nil, err
 	}
@@ -38,14 +53,45 @@ func NewHintfile(directory string, id int) (Hintfile, error) {
 	}
 
 	codec := NewCodec(f)
+	codec.keys = k
+	var headerSize int64
+	var count uint32
+	if stat.Size() == 0 {
+		headerSize, err = codec.EncodeHeader(hintfileMagic)
+	} else {
+		headerSize, err = codec.DecodeHeader(hintfileMagic)
+		if err == nil && codec.format.hintChecksum {
+			count, err = readHintFooter(f, codec, headerSize, stat.Size())
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 	return &hintfile{
-		id:    id,
-		name:  stat.Name(),
-		file:  f,
-		codec: codec,
+		id:     id,
+		name:   stat.Name(),
+		file:   f,
+		codec:  codec,
+		count:  count,
+		offset: headerSize,
+		size:   stat.Size(),
 	}, nil
 }
 
+// readHintFooter reads the footer at the end of a hintfile, a hintfile
+// without one was never completely written
+func readHintFooter(f File, codec *Codec, headerSize, size int64) (uint32, error) {
+	if size-headerSize < HINT_FOOTER_SIZE {
+		return 0, ErrCorruptedData
+	}
+	buf := make([]byte, HINT_FOOTER_SIZE)
+	if _, err := f.ReadAt(buf, size-HINT_FOOTER_SIZE); err != nil {
+		return 0, err
+	}
+	return codec.DecodeHintFooter(buf)
+}
+
 func (h *hintfile) ID() int {
 	return h.id
 }
@@ -54,17 +100,48 @@ func (h *hintfile) Name() string {
 	return h.name
 }
 
+func (h *hintfile) Version() uint16 {
+	return h.codec.Version()
+}
+
 func (h *hintfile) Write(hint Hint) (int64, error) {
 	bytesWritten, err := h.codec.EncodeHint(&hint)
+	if err == nil {
+		h.count++
+	}
 	return bytesWritten, err
 }
 
+func (h *hintfile) Finish() error {
+	_, err := h.codec.EncodeHintFooter(h.count)
+	return err
+}
+
 func (h *hintfile) Read() (hint Hint, err error) {
+	if h.codec.format.hintChecksum && h.read == h.count {
+		// every hint the footer announced was read, they must end right
+		// where the footer starts
+		if h.offset != h.size-HINT_FOOTER_SIZE {
+			return hint, ErrCorruptedData
+		}
+		return hint, io.EOF
+	}
 	// codec has the filehandler, so can keep track of reads
-	err = h.codec.DecodeHint(&hint)
+	if err = h.codec.DecodeHint(&hint); err != nil {
+		if err == io.EOF && h.codec.format.hintChecksum {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	h.read++
+	h.offset += h.codec.format.hintHeaderSize() + int64(hint.KeySize)
 	return
 }
 
+func (h *hintfile) Sync() error {
+	return h.file.Sync()
+}
+
 func (h *hintfile) Close() error {
 	return h.file.Close()
 }
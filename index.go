@@ -0,0 +1,85 @@
+package memorylanedb
+
+// IndexType selects the in-memory structure that maps keys to entries.
+type IndexType int
+
+const (
+	// INDEX_HASH is a Go map, it is the fastest for point lookups but has no
+	// key order, so Scan is not available.
+	INDEX_HASH IndexType = iota
+	// INDEX_BTREE keeps keys sorted, which Scan and ReverseScan need.
+	INDEX_BTREE
+	// INDEX_COMPACT packs keys and entries into flat arrays without
+	// pointers, it takes far less memory than INDEX_HASH for large keyspaces
+	// and keeps the garbage collector out of it. It has no key order.
+	INDEX_COMPACT
+)
+
+// index maps keys to the location of their latest entry. It is not safe for
+// concurrent use, the DB guards it with mu.
+type index interface {
+	Get(key Key) (EntryItem, bool)
+	Put(key Key, item EntryItem)
+	Delete(key Key)
+	Len() int
+	// Range calls fn for every key until fn returns false, the order depends
+	// on the implementation
+	Range(fn func(key Key, item EntryItem) bool)
+	Clone() index
+}
+
+// orderedIndex is an index that can visit the keys in [start, end) in order.
+// An empty start or end leaves that side of the range unbounded.
+type orderedIndex interface {
+	index
+	Ascend(start, end Key, fn func(key Key, item EntryItem) bool)
+	Descend(start, end Key, fn func(key Key, item EntryItem) bool)
+}
+
+func newIndex(t IndexType, shards int) index {
+	switch {
+	case t == INDEX_BTREE:
+		return newBTreeIndex()
+	case t == INDEX_COMPACT:
+		return newCompactIndex()
+	case shards > 1:
+		return newShardedIndex(shards)
+	default:
+		return hashIndex{}
+	}
+}
+
+type hashIndex map[Key]EntryItem
+
+func (h hashIndex) Get(key Key) (EntryItem, bool) {
+	item, ok := h[key]
+	return item, ok
+}
+
+func (h hashIndex) Put(key Key, item EntryItem) {
+	h[key] = item
+}
+
+func (h hashIndex) Delete(key Key) {
+	delete(h, key)
+}
+
+func (h hashIndex) Len() int {
+	return len(h)
+}
+
+func (h hashIndex) Range(fn func(key Key, item EntryItem) bool) {
+	for k, item := range h {
+		if !fn(k, item) {
+			return
+		}
+	}
+}
+
+func (h hashIndex) Clone() index {
+	c := make(hashIndex, len(h))
+	for k, item := range h {
+		c[k] = item
+	}
+	return c
+}
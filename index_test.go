@@ -0,0 +1,172 @@
+package memorylanedb
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestBTreeIndex(t *testing.T) {
+	assert := assert2.New(t)
+	rng := rand.New(rand.NewSource(1))
+
+	// replay random operations against the hash index as a reference
+	tree := newBTreeIndex()
+	reference := hashIndex{}
+	for i := 0; i < 20000; i++ {
+		key := Key(fmt.Sprintf("key%05d", rng.Intn(5000)))
+		if rng.Intn(3) == 0 {
+			tree.Delete(key)
+			reference.Delete(key)
+			continue
+		}
+		item := EntryItem{entryOffset: uint64(i)}
+		tree.Put(key, item)
+		reference.Put(key, item)
+	}
+	assert.Equal(reference.Len(), tree.Len())
+
+	var keys []string
+	reference.Range(func(key Key, item EntryItem) bool {
+		got, ok := tree.Get(key)
+		assert.True(ok)
+		assert.Equal(item, got)
+		keys = append(keys, string(key))
+		return true
+	})
+	sort.Strings(keys)
+
+	t.Run("Ascend", func(t *testing.T) {
+		var got []string
+		tree.Range(func(key Key, _ EntryItem) bool {
+			got = append(got, string(key))
+			return true
+		})
+		assert.Equal(keys, got)
+
+		got = got[:0]
+		tree.Ascend("key01000", "key02000", func(key Key, _ EntryItem) bool {
+			got = append(got, string(key))
+			return true
+		})
+		var want []string
+		for _, k := range keys {
+			if k >= "key01000" && k < "key02000" {
+				want = append(want, k)
+			}
+		}
+		assert.Equal(want, got)
+	})
+
+	t.Run("Descend", func(t *testing.T) {
+		var got []string
+		tree.Descend("key01000", "key02000", func(key Key, _ EntryItem) bool {
+			got = append(got, string(key))
+			return true
+		})
+		var want []string
+		for i := len(keys) - 1; i >= 0; i-- {
+			if keys[i] >= "key01000" && keys[i] < "key02000" {
+				want = append(want, keys[i])
+			}
+		}
+		assert.Equal(want, got)
+	})
+
+	t.Run("Clone", func(t *testing.T) {
+		clone := tree.Clone()
+		for _, k := range keys {
+			tree.Delete(Key(k))
+		}
+		assert.Equal(0, tree.Len())
+		assert.Equal(len(keys), clone.Len())
+		_, ok := clone.Get(Key(keys[0]))
+		assert.True(ok)
+	})
+}
+
+func TestCompactIndex(t *testing.T) {
+	assert := assert2.New(t)
+	rng := rand.New(rand.NewSource(1))
+
+	// long keys so deletes leave enough garbage to compact the arena
+	padding := strings.Repeat("x", 200)
+	compact := newCompactIndex()
+	reference := hashIndex{}
+	for i := 0; i < 50000; i++ {
+		key := Key(fmt.Sprintf("key%05d%s", rng.Intn(5000), padding))
+		if rng.Intn(3) == 0 {
+			compact.Delete(key)
+			reference.Delete(key)
+			continue
+		}
+		item := EntryItem{fileId: uint(i % 7), entryOffset: uint64(i), expiry: uint32(i), seq: uint64(i)}
+		compact.Put(key, item)
+		reference.Put(key, item)
+	}
+	assert.Equal(reference.Len(), compact.Len())
+	assert.Less(compact.used, 2*5000*(len("key00000")+len(padding)+2)+COMPACT_ARENA_CHUNK_SIZE)
+
+	got := hashIndex{}
+	compact.Range(func(key Key, item EntryItem) bool {
+		got[key] = item
+		return true
+	})
+	assert.Equal(reference, got)
+	reference.Range(func(key Key, item EntryItem) bool {
+		found, ok := compact.Get(key)
+		assert.True(ok)
+		assert.Equal(item, found)
+		return true
+	})
+
+	t.Run("Clone", func(t *testing.T) {
+		clone := compact.Clone()
+		reference.Range(func(key Key, _ EntryItem) bool {
+			compact.Delete(key)
+			return true
+		})
+		assert.Equal(0, compact.Len())
+		_, ok := compact.Get("missing")
+		assert.False(ok)
+		assert.Equal(reference.Len(), clone.Len())
+		clone.Put("new", EntryItem{seq: 1})
+		reference.Range(func(key Key, item EntryItem) bool {
+			found, ok := clone.Get(key)
+			assert.True(ok)
+			assert.Equal(item, found)
+			return true
+		})
+	})
+}
+
+// BenchmarkIndexMemory reports the heap each index takes per key
+func BenchmarkIndexMemory(b *testing.B) {
+	for _, indexType := range []struct {
+		name string
+		t    IndexType
+	}{
+		{"Hash", INDEX_HASH},
+		{"BTree", INDEX_BTREE},
+		{"Compact", INDEX_COMPACT},
+	} {
+		b.Run(indexType.name, func(b *testing.B) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			idx := newIndex(indexType.t, 0)
+			for i := 0; i < b.N; i++ {
+				idx.Put(Key(fmt.Sprintf("user:%012d", i)), EntryItem{entryOffset: uint64(i)})
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(b.N), "B/key")
+			runtime.KeepAlive(idx)
+		})
+	}
+}
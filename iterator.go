@@ -0,0 +1,156 @@
+package memorylanedb
+
+import (
+	"sort"
+	"strings"
+)
+
+type IterOptions struct {
+	// Prefix limits the iterator to keys starting with it, empty for all keys
+	Prefix Key
+}
+
+// DBIterator walks the keys of the DB in ascending order together with their
+// values. The set of keys is fixed when the iterator is created, like a
+// Snapshot, but values are only read from the datafiles when Value is called.
+// A DBIterator is not safe for concurrent use and must be closed.
+//
+//	it := db.NewIterator(IterOptions{Prefix: "user:"})
+//	defer it.Close()
+//	for it.Next() {
+//		value := it.Value()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type DBIterator struct {
+	db      *DB
+	items   []iterItem
+	pos     int
+	fileIDs []int
+	err     error
+	closed  bool // guarded by db.mu
+}
+
+type iterItem struct {
+	key  Key
+	item EntryItem
+}
+
+// NewIterator creates an iterator over the keys matching opts. Without an
+// ordered index the matching keys are sorted first, which costs time
+// proportional to their number.
+func (db *DB) NewIterator(opts IterOptions) *DBIterator {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return &DBIterator{db: db, pos: -1, err: ErrDBClosed, closed: true}
+	}
+
+	now := db.now()
+	var items []iterItem
+	collect := func(k Key, item EntryItem) bool {
+		if !item.isExpired(now) {
+			items = append(items, iterItem{k, item})
+		}
+		return true
+	}
+	if ordered, ok := db.keyDir.(orderedIndex); ok {
+		ordered.Ascend(opts.Prefix, prefixEnd(opts.Prefix), collect)
+	} else {
+		db.keyDir.Range(func(k Key, item EntryItem) bool {
+			if strings.HasPrefix(string(k), string(opts.Prefix)) {
+				return collect(k, item)
+			}
+			return true
+		})
+		sort.Slice(items, func(i, j int) bool {
+			return items[i].key < items[j].key
+		})
+	}
+	return &DBIterator{
+		db:      db,
+		items:   items,
+		pos:     -1,
+		fileIDs: db.pinFiles(),
+	}
+}
+
+// Next advances to the next key, it returns false once the keys are exhausted
+// or an error occurred.
+func (it *DBIterator) Next() bool {
+	if it.err != nil || it.pos >= len(it.items) {
+		return false
+	}
+	it.pos++
+	return it.pos < len(it.items)
+}
+
+// Key returns the current key.
+func (it *DBIterator) Key() Key {
+	if it.pos < 0 || it.pos >= len(it.items) {
+		return ""
+	}
+	return it.items[it.pos].key
+}
+
+// Value reads the value of the current key. On failure it returns nil and the
+// error is reported by Err.
+func (it *DBIterator) Value() []byte {
+	if it.err != nil || it.pos < 0 || it.pos >= len(it.items) {
+		return nil
+	}
+	db := it.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		it.err = ErrDBClosed
+		return nil
+	}
+	if it.closed {
+		it.err = ErrIteratorClosed
+		return nil
+	}
+	value, err := db.readValue(it.items[it.pos].key, it.items[it.pos].item)
+	if err != nil {
+		it.err = err
+		return nil
+	}
+	return value
+}
+
+// Err returns the first error the iterator ran into.
+func (it *DBIterator) Err() error {
+	return it.err
+}
+
+// Close releases the datafiles pinned by the iterator.
+func (it *DBIterator) Close() error {
+	db := it.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.items = nil
+	if db.closed {
+		// the DB closed every file already
+		return nil
+	}
+	return db.unpinFiles(it.fileIDs)
+}
+
+// prefixEnd returns the first key after every key starting with prefix, or an
+// empty key if there is none
+func prefixEnd(prefix Key) Key {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return Key(end[:i+1])
+		}
+	}
+	return ""
+}
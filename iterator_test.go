@@ -0,0 +1,80 @@
+package memorylanedb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestIterator(t *testing.T) {
+	for _, index := range []IndexType{INDEX_HASH, INDEX_BTREE} {
+		t.Run(fmt.Sprintf("Index%d", index), func(t *testing.T) {
+			testIterator(t, index)
+		})
+	}
+}
+
+func testIterator(t *testing.T, index IndexType) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	db, err := NewDB(directory, &Option{MaxValueSize: MAX_VALUE_SIZE, Index: index})
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+	for _, k := range []Key{"user:3", "user:1", "order:1", "user:2", "users"} {
+		assert.NoError(db.Put(k, []byte("v-"+k)))
+	}
+	assert.NoError(db.Delete("user:2"))
+
+	t.Run("Prefix", func(t *testing.T) {
+		it := db.NewIterator(IterOptions{Prefix: "user:"})
+		defer it.Close()
+		var keys []Key
+		for it.Next() {
+			keys = append(keys, it.Key())
+			assert.Equal([]byte("v-"+it.Key()), it.Value())
+		}
+		assert.NoError(it.Err())
+		assert.Equal([]Key{"user:1", "user:3"}, keys)
+	})
+
+	t.Run("StableUnderWrites", func(t *testing.T) {
+		it := db.NewIterator(IterOptions{})
+		assert.NoError(db.Put("user:1", []byte("changed")))
+		assert.NoError(db.Put("user:4", []byte("new")))
+		db.mu.Lock()
+		assert.NoError(db.rotate())
+		db.mu.Unlock()
+		assert.NoError(db.Merge(context.Background()))
+
+		var keys []Key
+		for it.Next() {
+			keys = append(keys, it.Key())
+			assert.Equal([]byte("v-"+it.Key()), it.Value())
+		}
+		assert.NoError(it.Err())
+		assert.Equal([]Key{"order:1", "user:1", "user:3", "users"}, keys)
+		assert.NoError(it.Close())
+		assert.Empty(db.obsoleteFiles)
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		it := db.NewIterator(IterOptions{})
+		assert.True(it.Next())
+		assert.NoError(it.Close())
+		assert.Nil(it.Value())
+		assert.False(it.Next())
+	})
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert := assert2.New(t)
+	assert.Equal(Key("ab"), prefixEnd("aa"))
+	assert.Equal(Key("b"), prefixEnd("a\xff"))
+	assert.Equal(Key(""), prefixEnd("\xff\xff"))
+	assert.Equal(Key(""), prefixEnd(""))
+}
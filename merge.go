@@ -0,0 +1,623 @@
+package memorylanedb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	MERGE_DIRNAME    = "merge"
+	MERGE_MARKERFILE = "merge.done"
+	// merged away datafiles that a snapshot still reads are moved here, out of
+	// sight of loadDB, until the snapshot is closed
+	OBSOLETE_DIRNAME = "obsolete"
+)
+
+/*
+	Merge compacts every immutable datafile into a merged datafile plus a
+	hintfile. The merged files are written into a scratch directory and only
+	moved next to the datafiles once a marker listing the merged inputs has
+	been committed, so a crash at any point either discards the merge or lets
+	the next open finish it:
+	- no marker: the scratch directory is removed, the inputs are untouched
+	- marker: the merged files are moved into place and the inputs removed
+*/
+
+// MergeWindow is a daily time window, expressed as offsets from local
+// midnight. A window whose End is before its Start wraps around midnight.
+type MergeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+func (w *MergeWindow) Contains(t time.Time) bool {
+	y, m, d := t.Date()
+	since := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	if w.Start <= w.End {
+		return since >= w.Start && since < w.End
+	}
+	return since >= w.Start || since < w.End
+}
+
+type mergedRecord struct {
+	key  Key
+	from EntryItem
+	to   EntryItem
+}
+
+// mergeResult is what mergeInto did: records were copied into the merged
+// datafiles listed in outputs, expired entries were dropped, and the live
+// values of the dropped blob files were copied into blobOutputs
+type mergeResult struct {
+	outputs      []int
+	blobOutputs  []int
+	droppedBlobs []Datafile
+	records      []mergedRecord
+	expired      []mergedRecord
+}
+
+// removedIDs are the ids of the files the merge replaces
+func (r *mergeResult) removedIDs(inputs []Datafile) []int {
+	ids := make([]int, 0, len(inputs)+len(r.droppedBlobs))
+	for _, df := range inputs {
+		ids = append(ids, df.ID())
+	}
+	for _, bf := range r.droppedBlobs {
+		ids = append(ids, bf.ID())
+	}
+	return ids
+}
+
+// Merge rewrites the live entries of all immutable datafiles into merged
+// datafiles of at most Option.MaxMergefileSize and removes the originals. The
+// active file is rotated first so everything written before the call is
+// compacted. Blob files are collected as well, see blob.go. Reads and writes
+// keep being served while the merge runs, Close cancels it.
+func (db *DB) Merge(ctx context.Context) error {
+	inputs, blobInputs, err := db.prepareMerge()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		db.mu.Lock()
+		db.merging = false
+		db.mu.Unlock()
+		db.wg.Done()
+	}()
+	if len(inputs) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-db.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	mergeDir := filepath.Join(db.path, MERGE_DIRNAME)
+	if err := db.fs.RemoveAll(mergeDir); err != nil {
+		return err
+	}
+	if err := db.fs.Mkdir(mergeDir, fs.ModeDir|fs.ModePerm); err != nil {
+		return err
+	}
+	result, err := db.mergeInto(ctx, mergeDir, inputs, blobInputs)
+	if err == nil {
+		err = writeMergeMarker(db.fs, mergeDir, result.removedIDs(inputs))
+	}
+	if err != nil {
+		db.fs.RemoveAll(mergeDir)
+		select {
+		case <-db.done:
+			return ErrDBClosed
+		default:
+			return err
+		}
+	}
+	return db.commitMerge(mergeDir, inputs, result)
+}
+
+// prepareMerge rotates the active file and returns the datafiles to merge and
+// the immutable blob files, oldest first
+func (db *DB) prepareMerge() ([]Datafile, []Datafile, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, nil, ErrDBClosed
+	}
+	if db.merging {
+		return nil, nil, ErrMergeInProgress
+	}
+	if err := db.failure(); err != nil {
+		return nil, nil, err
+	}
+	// an active file holding only its header has nothing to merge
+	if db.activeDataFile.Size() > FILE_HEADER_SIZE {
+		if err := db.rotate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	db.merging = true
+	// Close waits for the merge, it checks closed under mu before waiting
+	db.wg.Add(1)
+
+	ids := make([]int, 0, len(db.immutableDataFiles))
+	for id := range db.immutableDataFiles {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, nil, nil
+	}
+	sort.Ints(ids)
+	inputs := make([]Datafile, 0, len(ids))
+	for _, id := range ids {
+		inputs = append(inputs, db.immutableDataFiles[id])
+	}
+	return inputs, db.immutableBlobFiles(), nil
+}
+
+// reserveFileID hands out an unused datafile id
+func (db *DB) reserveFileID() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.maxFileId++
+	return db.maxFileId
+}
+
+// mergeWriter writes the merged datafiles and their hintfiles, starting a new
+// pair whenever the current datafile is full, and the blob files values are
+// copied into
+type mergeWriter struct {
+	db          *DB
+	dir         string
+	mergefile   Datafile
+	hintfile    Hintfile
+	outputs     []int
+	blobfile    Datafile
+	blobOutputs []int
+}
+
+// write copies entry into the current merged datafile and returns its new
+// location
+func (mw *mergeWriter) write(entry Entry) (EntryItem, error) {
+	if mw.mergefile != nil && mw.mergefile.Size()+entry.Size() > mw.db.maxMergefileSize {
+		if err := mw.finish(); err != nil {
+			return EntryItem{}, err
+		}
+	}
+	if mw.mergefile == nil {
+		if err := mw.next(); err != nil {
+			return EntryItem{}, err
+		}
+	}
+	offset_before_write, bytesWritten, err := mw.mergefile.Write(entry)
+	if err != nil {
+		return EntryItem{}, err
+	}
+	hint := entry.toHint()
+	hint.ValueOffset = uint64(offset_before_write)
+	// write hint in hintfile
+	if _, err = mw.hintfile.Write(*hint); err != nil {
+		return EntryItem{}, err
+	}
+	_, entryItem := entry.produceRecord(mw.mergefile.ID(), uint64(offset_before_write), uint64(bytesWritten))
+	return entryItem, nil
+}
+
+// writeBlob copies a blob file entry into the current merged blob file and
+// returns where it went
+func (mw *mergeWriter) writeBlob(blob Entry) (blobPointer, error) {
+	if mw.blobfile != nil && mw.blobfile.Size()+blob.Size() > mw.db.maxMergefileSize {
+		if err := mw.finishBlob(); err != nil {
+			return blobPointer{}, err
+		}
+	}
+	if mw.blobfile == nil {
+		id := mw.db.reserveFileID()
+		blobfile, err := NewDatafile(mw.dir, id, mw.db.fileOptions(AsBlobFile())...)
+		if err != nil {
+			return blobPointer{}, err
+		}
+		mw.blobfile = blobfile
+		mw.blobOutputs = append(mw.blobOutputs, id)
+	}
+	offset, size, err := mw.blobfile.Write(blob)
+	if err != nil {
+		return blobPointer{}, err
+	}
+	return blobPointer{uint32(mw.blobfile.ID()), uint64(offset), uint64(size)}, nil
+}
+
+// finishBlob closes the current merged blob file
+func (mw *mergeWriter) finishBlob() error {
+	if mw.blobfile == nil {
+		return nil
+	}
+	err := mw.blobfile.Close()
+	mw.blobfile = nil
+	return err
+}
+
+func (mw *mergeWriter) next() error {
+	id := mw.db.reserveFileID()
+	mergefile, err := NewDatafile(mw.dir, id, mw.db.fileOptions(AsMergedFile())...)
+	if err != nil {
+		return err
+	}
+	hintfile, err := openHintfile(mw.db.fs, mw.dir, id, mw.db.keys)
+	if err != nil {
+		mergefile.Close()
+		return err
+	}
+	mw.mergefile, mw.hintfile = mergefile, hintfile
+	mw.outputs = append(mw.outputs, id)
+	return nil
+}
+
+// finish completes and closes the current merged datafile and hintfile
+func (mw *mergeWriter) finish() error {
+	if mw.mergefile == nil {
+		return nil
+	}
+	err := mw.hintfile.Finish()
+	if err == nil {
+		err = mw.hintfile.Sync()
+	}
+	if closeErr := mw.hintfile.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := mw.mergefile.Close(); err == nil {
+		err = closeErr
+	}
+	mw.mergefile, mw.hintfile = nil, nil
+	return err
+}
+
+// close releases the current files after a failed merge
+func (mw *mergeWriter) close() {
+	if mw.mergefile != nil {
+		mw.mergefile.Close()
+		mw.hintfile.Close()
+	}
+	if mw.blobfile != nil {
+		mw.blobfile.Close()
+	}
+}
+
+// mergeInto copies the entries of inputs that the keyDir still points at into
+// merged datafiles and hintfiles in mergeDir, dropping expired ones. The live
+// values of the blob inputs that are dropped are copied along.
+func (db *DB) mergeInto(ctx context.Context, mergeDir string, inputs, blobInputs []Datafile) (*mergeResult, error) {
+	mw := &mergeWriter{db: db, dir: mergeDir}
+	defer mw.close()
+	var result mergeResult
+	now := db.now()
+
+	gc := &blobGC{}
+	if len(blobInputs) > 0 {
+		var err error
+		if gc, err = db.planBlobGC(ctx, inputs, blobInputs); err != nil {
+			return nil, err
+		}
+	}
+	err := db.scanLive(ctx, inputs, func(entry EntryWithOffset, entryItem EntryItem) error {
+		key := Key(entry.Key)
+		if entryItem.isExpired(now) {
+			result.expired = append(result.expired, mergedRecord{key: key, from: entryItem})
+			return nil
+		}
+		// a merged entry no longer belongs to a batch since its batch
+		// was committed
+		entry.Flags &^= FLAG_BATCH
+		if entry.IsBlobPointer() {
+			if err := gc.relocate(mw, &entry.Entry); err != nil {
+				return err
+			}
+		} else if err := db.recompressValue(&entry.Entry); err != nil {
+			return err
+		}
+		newEntryItem, err := mw.write(entry.Entry)
+		if err != nil {
+			return err
+		}
+		result.records = append(result.records, mergedRecord{key, entryItem, newEntryItem})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mw.finish(); err != nil {
+		return nil, err
+	}
+	if err := mw.finishBlob(); err != nil {
+		return nil, err
+	}
+	result.outputs = mw.outputs
+	result.blobOutputs = mw.blobOutputs
+	result.droppedBlobs = gc.drop
+	return &result, nil
+}
+
+// scanLive calls fn for every entry of inputs that the keyDir still points at
+func (db *DB) scanLive(ctx context.Context, inputs []Datafile, fn func(entry EntryWithOffset, item EntryItem) error) error {
+	for _, df := range inputs {
+		datafileIterator := df.CreateIterator()
+		for datafileIterator.hasNext() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			entry, err := datafileIterator.getNext()
+			if err != nil {
+				return err
+			}
+			db.mu.RLock()
+			entryItem, ok := db.keyDir.Get(Key(entry.Key))
+			db.mu.RUnlock()
+			if !ok {
+				continue
+			}
+			if !(entryItem.fileId == uint(df.ID()) && entryItem.entryOffset == entry.Offset) {
+				continue
+			}
+			if err := fn(entry, entryItem); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// commitMerge moves the merged files into place, repoints the keyDir entries
+// that were not overwritten during the merge and removes the inputs
+func (db *DB) commitMerge(mergeDir string, inputs []Datafile, result *mergeResult) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.moveMergedFiles(mergeDir); err != nil {
+		return err
+	}
+	for _, r := range result.expired {
+		if item, ok := db.keyDir.Get(r.key); ok && item == r.from {
+			db.deleteKey(r.key)
+		}
+	}
+	if err := db.openMergedFiles(result.outputs, result.blobOutputs); err != nil {
+		return err
+	}
+	for _, r := range result.records {
+		if item, ok := db.keyDir.Get(r.key); ok && item == r.from {
+			db.relocateKey(r.key, r.to)
+		} else {
+			// overwritten or deleted while the merge was running
+			db.statsFor(r.to.fileId).DeadBytes += int64(r.to.entrySize)
+		}
+	}
+
+	// no key points into the inputs anymore, but readers of a sharded keyDir
+	// may still be reading them
+	unlock := db.lockReaders()
+	defer unlock()
+	ids := make([]int, 0, len(inputs)+len(result.droppedBlobs))
+	for _, bf := range result.droppedBlobs {
+		delete(db.blobFiles, bf.ID())
+	}
+	for _, df := range append(inputs, result.droppedBlobs...) {
+		delete(db.immutableDataFiles, df.ID())
+		delete(db.fileStats, df.ID())
+		if db.fileRefs[df.ID()] > 0 {
+			if err := db.retireDatafile(df); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := df.Close(); err != nil {
+			return err
+		}
+		ids = append(ids, df.ID())
+	}
+	if err := db.removeMergedInputs(ids); err != nil {
+		return err
+	}
+	return db.fs.RemoveAll(mergeDir)
+}
+
+// openMergedFiles adds the merged datafiles and blob files to the immutable
+// ones; callers must hold mu
+func (db *DB) openMergedFiles(ids, blobIDs []int) error {
+	defer db.lockReaders()()
+	for _, id := range ids {
+		df, err := NewDatafile(db.path, id, append(db.readOnlyOptions(), AsMergedFile())...)
+		if err != nil {
+			return err
+		}
+		db.immutableDataFiles[id] = df
+	}
+	for _, id := range blobIDs {
+		bf, err := NewDatafile(db.path, id, append(db.readOnlyOptions(), AsBlobFile())...)
+		if err != nil {
+			return err
+		}
+		db.blobFiles[id] = bf
+	}
+	return nil
+}
+
+// retireDatafile moves a merged away datafile that is pinned by a snapshot
+// out of the database, keeping it open for the snapshot; callers must hold mu
+func (db *DB) retireDatafile(df Datafile) error {
+	obsoleteDir := filepath.Join(db.path, OBSOLETE_DIRNAME)
+	if err := db.fs.MkdirAll(obsoleteDir, fs.ModeDir|fs.ModePerm); err != nil {
+		return err
+	}
+	if err := db.fs.Rename(filepath.Join(db.path, df.Name()), filepath.Join(obsoleteDir, df.Name())); err != nil {
+		return err
+	}
+	db.obsoleteFiles[df.ID()] = df
+	// snapshots never read hintfiles
+	err := db.fs.Remove(filepath.Join(db.path, fmt.Sprintf(hintfileDefaultName, df.ID())))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// recoverMerge completes or discards a merge interrupted by a crash, and
+// drops datafiles retired for snapshots of the previous process
+func (db *DB) recoverMerge() error {
+	if err := db.fs.RemoveAll(filepath.Join(db.path, OBSOLETE_DIRNAME)); err != nil {
+		return err
+	}
+	mergeDir := filepath.Join(db.path, MERGE_DIRNAME)
+	ids, err := readMergeMarker(db.fs, mergeDir)
+	if errors.Is(err, os.ErrNotExist) {
+		// merge never committed
+		return db.fs.RemoveAll(mergeDir)
+	}
+	if err != nil {
+		return err
+	}
+	if err := db.moveMergedFiles(mergeDir); err != nil {
+		return err
+	}
+	if err := db.removeMergedInputs(ids); err != nil {
+		return err
+	}
+	return db.fs.RemoveAll(mergeDir)
+}
+
+func (db *DB) moveMergedFiles(mergeDir string) error {
+	names, err := db.fs.List(mergeDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !isMergedDatafile(name) && !strings.HasSuffix(name, HINTFILE_SUFFIX) &&
+			!strings.HasSuffix(name, BLOBFILE_SUFFIX) {
+			continue
+		}
+		if err := db.fs.Rename(filepath.Join(mergeDir, name), filepath.Join(db.path, name)); err != nil {
+			return err
+		}
+	}
+	return db.fs.SyncDir(db.path)
+}
+
+func (db *DB) removeMergedInputs(ids []int) error {
+	for _, id := range ids {
+		for _, pattern := range []string{datafileDefaultName, mergedDatafileDefaultName, hintfileDefaultName, blobfileDefaultName} {
+			err := db.fs.Remove(filepath.Join(db.path, fmt.Sprintf(pattern, id)))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeMergeMarker atomically records the ids of the files the merge
+// replaces, its presence is what commits the merge
+func writeMergeMarker(fsys FS, mergeDir string, ids []int) error {
+	var sb strings.Builder
+	for _, id := range ids {
+		sb.WriteString(strconv.Itoa(id))
+		sb.WriteByte('\n')
+	}
+	tmp := filepath.Join(mergeDir, MERGE_MARKERFILE+".tmp")
+	f, err := fsys.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(f, sb.String()); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := fsys.Rename(tmp, filepath.Join(mergeDir, MERGE_MARKERFILE)); err != nil {
+		return err
+	}
+	return fsys.SyncDir(mergeDir)
+}
+
+func readMergeMarker(fsys FS, mergeDir string) ([]int, error) {
+	f, err := fsys.OpenFile(filepath.Join(mergeDir, MERGE_MARKERFILE), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ids []int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		id, err := strconv.Atoi(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, scanner.Err()
+}
+
+// deadRatio is the fraction of immutable datafile bytes that the keyDir no
+// longer references
+func (db *DB) deadRatio() float64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var total, dead int64
+	for id, df := range db.immutableDataFiles {
+		total += df.Size()
+		if st, ok := db.fileStats[id]; ok {
+			dead += st.DeadBytes
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(dead) / float64(total)
+}
+
+func (db *DB) shouldMerge(now time.Time) bool {
+	if db.mergeWindow != nil && !db.mergeWindow.Contains(now) {
+		return false
+	}
+	ratio := db.deadRatio()
+	return ratio > 0 && ratio >= db.mergeMinDeadRatio
+}
+
+func (db *DB) runMergeScheduler(ctx context.Context) {
+	defer db.wg.Done()
+	ticker := time.NewTicker(db.mergeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !db.shouldMerge(now) {
+				continue
+			}
+			err := db.Merge(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, ErrMergeInProgress) && !errors.Is(err, ErrDBClosed) {
+				log.Error().Err(err).Str("path", db.path).Msg("scheduled merge failed")
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package memorylanedb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestMerge(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	db, err := NewDB(directory, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), []byte("old")))
+	}
+	for i := 0; i < 5; i++ {
+		assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), []byte("new")))
+	}
+	assert.NoError(db.Delete("key9"))
+
+	t.Run("Merge", func(t *testing.T) {
+		assert.NoError(db.Merge(context.Background()))
+		for i := 0; i < 9; i++ {
+			value, err := db.Get(Key(fmt.Sprintf("key%d", i)))
+			assert.NoError(err)
+			if i < 5 {
+				assert.Equal([]byte("new"), value)
+			} else {
+				assert.Equal([]byte("old"), value)
+			}
+		}
+		_, err := db.Get("key9")
+		assert.ErrorIs(err, ErrKeyNotFound)
+
+		merged, _ := filepath.Glob(filepath.Join(directory, "*"+MERGED_DATAFILE_SUFFIX))
+		hints, _ := filepath.Glob(filepath.Join(directory, "*"+HINTFILE_SUFFIX))
+		assert.Len(merged, 1)
+		assert.Len(hints, 1)
+		assert.NoDirExists(filepath.Join(directory, MERGE_DIRNAME))
+	})
+
+	t.Run("WriteAfterMerge", func(t *testing.T) {
+		assert.NoError(db.Put("key0", []byte("newer")))
+		assert.NoError(db.Delete("key8"))
+		assert.NoError(db.Merge(context.Background()))
+		merged, _ := filepath.Glob(filepath.Join(directory, "*"+MERGED_DATAFILE_SUFFIX))
+		assert.Len(merged, 1)
+	})
+
+	t.Run("EmptyActiveFile", func(t *testing.T) {
+		// the previous merge left a fresh active file, another one keeps it
+		db.mu.RLock()
+		active := db.activeDataFile.ID()
+		db.mu.RUnlock()
+		assert.NoError(db.Merge(context.Background()))
+		db.mu.RLock()
+		assert.Equal(active, db.activeDataFile.ID())
+		db.mu.RUnlock()
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		assert.NoError(db.Put("key1", []byte("newest")))
+		assert.NoError(db.Close())
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		value, err := db.Get("key0")
+		assert.NoError(err)
+		assert.Equal([]byte("newer"), value)
+		value, err = db.Get("key1")
+		assert.NoError(err)
+		assert.Equal([]byte("newest"), value)
+		value, err = db.Get("key7")
+		assert.NoError(err)
+		assert.Equal([]byte("old"), value)
+		_, err = db.Get("key8")
+		assert.ErrorIs(err, ErrKeyNotFound)
+	})
+}
+
+func TestMergeRecovery(t *testing.T) {
+	assert := assert2.New(t)
+
+	t.Run("Uncommitted", func(t *testing.T) {
+		directory := t.TempDir()
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(db.Put("foo", []byte("bar")))
+		assert.NoError(db.Close())
+
+		// a merge that crashed before writing its marker
+		mergeDir := filepath.Join(directory, MERGE_DIRNAME)
+		assert.NoError(os.Mkdir(mergeDir, 0700))
+		assert.NoError(os.WriteFile(filepath.Join(mergeDir, fmt.Sprintf(mergedDatafileDefaultName, 1)), []byte("partial"), 0600))
+
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		assert.NoDirExists(mergeDir)
+		value, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+	})
+
+	t.Run("Committed", func(t *testing.T) {
+		directory := t.TempDir()
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(db.Put("foo", []byte("bar")))
+		assert.NoError(db.Close())
+
+		// a merge that crashed after its marker but before the inputs were
+		// removed: the merged copy must win over the stale input
+		mergeDir := filepath.Join(directory, MERGE_DIRNAME)
+		assert.NoError(os.Mkdir(mergeDir, 0700))
+		mf, err := NewDatafile(mergeDir, 1, AsMergedFile())
+		if !assert.NoError(err) {
+			return
+		}
+		entry := NewEntry([]byte("baz"), []byte("qux"))
+		_, _, err = mf.Write(entry)
+		assert.NoError(err)
+		assert.NoError(mf.Close())
+		assert.NoError(os.WriteFile(filepath.Join(mergeDir, MERGE_MARKERFILE), []byte("0\n"), 0600))
+
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		assert.NoDirExists(mergeDir)
+		assert.NoFileExists(filepath.Join(directory, fmt.Sprintf(datafileDefaultName, 0)))
+		_, err = db.Get("foo")
+		assert.ErrorIs(err, ErrKeyNotFound)
+		value, err := db.Get("baz")
+		assert.NoError(err)
+		assert.Equal([]byte("qux"), value)
+	})
+}
+
+func TestMergeScheduler(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	db, err := NewDB(directory, &Option{
+		MaxValueSize:      MAX_VALUE_SIZE,
+		MergeInterval:     10 * time.Millisecond,
+		MergeMinDeadRatio: 0.1,
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		assert.NoError(db.Put("foo", []byte(fmt.Sprintf("bar%d", i))))
+	}
+	// nothing is immutable yet, so nothing is dead
+	assert.Equal(0.0, db.deadRatio())
+
+	// rotate so the overwritten entries become mergeable
+	db.mu.Lock()
+	assert.NoError(db.rotate())
+	db.mu.Unlock()
+	assert.Eventually(func() bool {
+		merged, _ := filepath.Glob(filepath.Join(directory, "*"+MERGED_DATAFILE_SUFFIX))
+		return len(merged) == 1 && db.deadRatio() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	value, err := db.Get("foo")
+	assert.NoError(err)
+	assert.Equal([]byte("bar9"), value)
+}
+
+func TestMergeWindow(t *testing.T) {
+	assert := assert2.New(t)
+	at := func(hour int) time.Time {
+		return time.Date(2023, 1, 1, hour, 30, 0, 0, time.Local)
+	}
+
+	w := &MergeWindow{Start: 1 * time.Hour, End: 5 * time.Hour}
+	assert.True(w.Contains(at(1)))
+	assert.True(w.Contains(at(4)))
+	assert.False(w.Contains(at(5)))
+	assert.False(w.Contains(at(23)))
+
+	// wraps around midnight
+	w = &MergeWindow{Start: 22 * time.Hour, End: 2 * time.Hour}
+	assert.True(w.Contains(at(23)))
+	assert.True(w.Contains(at(0)))
+	assert.False(w.Contains(at(2)))
+	assert.False(w.Contains(at(12)))
+
+	t.Run("Validation", func(t *testing.T) {
+		for _, opts := range []*Option{
+			{MergeInterval: -time.Second},
+			{MergeMinDeadRatio: -0.1},
+			{MergeMinDeadRatio: 1.5},
+			{MergeWindow: &MergeWindow{Start: -time.Hour, End: time.Hour}},
+			{MergeWindow: &MergeWindow{Start: time.Hour, End: 25 * time.Hour}},
+			{MergeWindow: &MergeWindow{Start: time.Hour, End: time.Hour}},
+		} {
+			_, err := NewDB(t.TempDir(), opts)
+			assert.ErrorIs(err, ErrInvalidOption)
+		}
+	})
+}
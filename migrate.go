@@ -0,0 +1,62 @@
+package memorylanedb
+
+import "context"
+
+// Migrate rewrites a database directory whose datafiles and hintfiles are in
+// an older format into CURRENT_FORMAT_VERSION, returning how many datafiles
+// and hintfiles were outdated. It opens the database itself with opts, so it
+// must not be open anywhere else; nil takes the DefaultOptions.
+//
+// The rewrite is a merge: old files are only read, the live entries are
+// written out in the current format and the old files removed once that has
+// been committed.
+func Migrate(ctx context.Context, path string, opts *Option) (outdated int, err error) {
+	db, err := NewDB(path, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	outdated, err = db.outdatedFiles()
+	if err != nil || outdated == 0 {
+		return 0, err
+	}
+	return outdated, db.Merge(ctx)
+}
+
+// outdatedFiles counts the immutable datafiles and the hintfiles that are not
+// in the current format
+func (db *DB) outdatedFiles() (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	outdated := 0
+	for _, df := range db.immutableDataFiles {
+		if df.Version() != CURRENT_FORMAT_VERSION {
+			outdated++
+		}
+	}
+	hintfiles, err := glob(db.fs, db.path, "*"+HINTFILE_SUFFIX)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ExtractIDsFromFilenames(hintfiles) {
+		hf, err := openHintfile(db.fs, db.path, id, db.keys)
+		if err != nil {
+			// loading already fell back to scanning its datafile, the merge
+			// rewrites it all the same
+			outdated++
+			continue
+		}
+		if hf.Version() != CURRENT_FORMAT_VERSION {
+			outdated++
+		}
+		if err := hf.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return outdated, nil
+}
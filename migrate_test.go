@@ -0,0 +1,135 @@
+package memorylanedb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestMigrate(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	legacy := append(encodeLegacyEntry("foo", "bar"), encodeLegacyEntry("baz", "qux")...)
+	legacy = append(legacy, encodeLegacyEntry("baz", TOMBSTONE_VALUE)...)
+	assert.NoError(os.WriteFile(filepath.Join(directory, fmt.Sprintf(datafileDefaultName, 0)), legacy, 0600))
+	assert.NoError(os.WriteFile(filepath.Join(directory, fmt.Sprintf(datafileDefaultName, 1)), encodeLegacyEntry("quux", "corge"), 0600))
+
+	migrated, err := Migrate(context.Background(), directory, nil)
+	assert.NoError(err)
+	assert.Equal(2, migrated)
+
+	t.Run("CurrentFormat", func(t *testing.T) {
+		filenames, err := filepath.Glob(filepath.Join(directory, "*"))
+		assert.NoError(err)
+		for _, fn := range filenames {
+			data, err := os.ReadFile(fn)
+			assert.NoError(err)
+			if len(data) == 0 {
+				continue
+			}
+			assert.True(isKnownMagic(data[:MAGIC_SIZE]), fn)
+			assert.Equal(CURRENT_FORMAT_VERSION, byteOrder.Uint16(data[MAGIC_SIZE:FILE_HEADER_SIZE]), fn)
+		}
+	})
+
+	t.Run("Idempotent", func(t *testing.T) {
+		migrated, err := Migrate(context.Background(), directory, nil)
+		assert.NoError(err)
+		assert.Equal(0, migrated)
+	})
+
+	t.Run("OutdatedHintfile", func(t *testing.T) {
+		// FORMAT_V5 hints are laid out like the current ones, only the file
+		// header differs
+		hintfiles, err := filepath.Glob(filepath.Join(directory, "*"+HINTFILE_SUFFIX))
+		if !assert.NoError(err) || !assert.Len(hintfiles, 1) {
+			return
+		}
+		data, err := os.ReadFile(hintfiles[0])
+		assert.NoError(err)
+		header := make([]byte, MAGIC_SIZE+VERSION_SIZE)
+		copy(header, hintfileMagic)
+		byteOrder.PutUint16(header[MAGIC_SIZE:], FORMAT_V5)
+		assert.NoError(os.WriteFile(hintfiles[0], append(header, data[FILE_HEADER_SIZE:]...), 0600))
+
+		migrated, err := Migrate(context.Background(), directory, nil)
+		assert.NoError(err)
+		assert.Equal(1, migrated)
+		migrated, err = Migrate(context.Background(), directory, nil)
+		assert.NoError(err)
+		assert.Equal(0, migrated)
+	})
+
+	t.Run("Options", func(t *testing.T) {
+		_, err := Migrate(context.Background(), directory, &Option{IndexShards: -1})
+		assert.ErrorIs(err, ErrInvalidOption)
+	})
+
+	t.Run("CloseError", func(t *testing.T) {
+		// an empty directory has nothing to migrate, so only closing the DB
+		// syncs its files
+		fsys := newFaultFS(NewMemFS())
+		errSync := errors.New("fsync failed")
+		fsys.failSyncs(errSync)
+		migrated, err := Migrate(context.Background(), "db", &Option{FS: fsys})
+		assert.ErrorIs(err, errSync)
+		assert.Equal(0, migrated)
+	})
+
+	t.Run("DataPreserved", func(t *testing.T) {
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		value, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		value, err = db.Get("quux")
+		assert.NoError(err)
+		assert.Equal([]byte("corge"), value)
+		_, err = db.Get("baz")
+		assert.ErrorIs(err, ErrKeyNotFound)
+	})
+}
+
+func TestForeignFiles(t *testing.T) {
+	assert := assert2.New(t)
+
+	t.Run("Datafile", func(t *testing.T) {
+		directory := t.TempDir()
+		path := filepath.Join(directory, fmt.Sprintf(datafileDefaultName, 0))
+		assert.NoError(os.WriteFile(path, []byte("certainly not a datafile"), 0600))
+		_, err := NewDatafile(directory, 0, AsReadOnly())
+		assert.ErrorIs(err, ErrInvalidFileHeader)
+	})
+
+	t.Run("HintfileAsDatafile", func(t *testing.T) {
+		directory := t.TempDir()
+		hf, err := NewHintfile(directory, 0)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(hf.Close())
+		assert.NoError(os.Rename(filepath.Join(directory, hf.Name()), filepath.Join(directory, fmt.Sprintf(datafileDefaultName, 0))))
+		_, err = NewDatafile(directory, 0, AsReadOnly())
+		assert.ErrorIs(err, ErrInvalidFileHeader)
+	})
+
+	t.Run("UnknownVersion", func(t *testing.T) {
+		directory := t.TempDir()
+		header := make([]byte, FILE_HEADER_SIZE)
+		copy(header, datafileMagic)
+		byteOrder.PutUint16(header[MAGIC_SIZE:], CURRENT_FORMAT_VERSION+1)
+		path := filepath.Join(directory, fmt.Sprintf(datafileDefaultName, 0))
+		assert.NoError(os.WriteFile(path, header, 0600))
+		_, err := NewDatafile(directory, 0, AsReadOnly())
+		assert.ErrorIs(err, ErrUnsupportedVersion)
+	})
+}
@@ -0,0 +1,162 @@
+package memorylanedb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TORN_SCAN_WINDOW is how much of a datafile after a bad entry is read at a
+// time when looking for a valid entry behind it
+const TORN_SCAN_WINDOW = 64 << 10
+
+// tornWriteError reports a datafile entry that could not be decoded or failed
+// its checksum. At the end of the newest datafile it is the remains of a write
+// interrupted by a crash.
+type tornWriteError struct {
+	offset int64 // where the bad entry starts
+	err    error
+}
+
+func (e *tornWriteError) Error() string {
+	return fmt.Sprintf("invalid entry at offset %d: %v", e.offset, e.err)
+}
+
+func (e *tornWriteError) Unwrap() error {
+	return e.err
+}
+
+// recoverTornHeader rewrites the header of a datafile that was created but
+// never got a complete header, such a file holds no entries
+func (db *DB) recoverTornHeader(id int) error {
+	path := filepath.Join(db.path, fmt.Sprintf(datafileDefaultName, id))
+	stat, err := db.fs.Stat(path)
+	if err != nil || stat.Size() >= FILE_HEADER_SIZE {
+		return err
+	}
+	buf, err := readHeader(db.fs, path, stat.Size())
+	if err != nil {
+		return err
+	}
+	// the key id and flags of the header are whatever it was created with
+	prefix := buf
+	if len(prefix) > MAGIC_SIZE+VERSION_SIZE {
+		prefix = prefix[:MAGIC_SIZE+VERSION_SIZE]
+	}
+	if !bytes.HasPrefix(fileHeader(datafileMagic, nil), prefix) {
+		return nil
+	}
+	log.Warn().Str("datafile", filepath.Base(path)).Int("bytes", len(buf)).
+		Msg("rewriting torn datafile header")
+	if err := truncateFile(db.fs, path, 0); err != nil {
+		return err
+	}
+	df, err := NewDatafile(db.path, id, db.fileOptions()...)
+	if err != nil {
+		return err
+	}
+	return df.Close()
+}
+
+// entryFollows reports whether a valid entry starts anywhere in df after
+// offset. A torn write is the last thing in a datafile, a bad entry followed
+// by good ones is corruption. The tail is read a window at a time and every
+// offset that decodes to a prefix is checked against its checksum.
+func entryFollows(df Datafile, offset int64) (bool, error) {
+	// the sealing is left out, the checksum covers the sealed bytes
+	codec := NewReaderCodec(nil, df.Version())
+	prefixSize := codec.entryHeaderSize()
+	size := df.Size()
+	buf := make([]byte, TORN_SCAN_WINDOW+prefixSize)
+	for start := offset + 1; start+prefixSize <= size; start += TORN_SCAN_WINDOW {
+		n, err := df.ReadAt(buf, start)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		window := buf[:n]
+		for i := 0; i < TORN_SCAN_WINDOW && int64(i)+prefixSize <= int64(n); i++ {
+			var entry Entry
+			if codec.decodeEntryPrefix(window[i:], &entry) != nil {
+				continue
+			}
+			entrySize := prefixSize + int64(entry.KeySize) + int64(entry.ValueSize)
+			if start+int64(i)+entrySize > size {
+				continue
+			}
+			candidate := window[i:]
+			if int64(len(candidate)) < entrySize {
+				candidate = make([]byte, entrySize)
+				if _, err := df.ReadAt(candidate, start+int64(i)); err != nil {
+					return false, err
+				}
+			}
+			if _, err := codec.DecodeSingleEntry(candidate[:entrySize], &entry); err == nil && entry.isValid() {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// recoverTornWrite truncates df at the bad entry torn reports if nothing valid
+// follows it, and reopens it
+func (db *DB) recoverTornWrite(df Datafile, torn *tornWriteError) (Datafile, error) {
+	follows, err := entryFollows(df, torn.offset)
+	if err != nil {
+		return df, err
+	}
+	if follows {
+		return df, fmt.Errorf("%w: %s: %v", ErrCorruptedData, df.Name(), torn)
+	}
+	return db.truncateDatafile(df, torn.offset, torn.err)
+}
+
+// truncateDatafile cuts df back to size, dropping a torn write at its end, and
+// reopens it
+func (db *DB) truncateDatafile(df Datafile, size int64, cause error) (Datafile, error) {
+	log.Warn().Err(cause).Str("datafile", df.Name()).Int64("offset", size).
+		Int64("bytes", df.Size()-size).Msg("truncating torn write at the end of datafile")
+	if err := df.Close(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(db.path, df.Name())
+	if err := truncateFile(db.fs, path, size); err != nil {
+		return nil, err
+	}
+	return NewDatafile(db.path, df.ID(), db.readOnlyOptions()...)
+}
+
+// readHeader returns the first size bytes of the file at path
+func readHeader(fsys FS, path string, size int64) ([]byte, error) {
+	f, err := fsys.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, size)
+	n, err := f.ReadAt(buf, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// truncateFile cuts the file at path to size and syncs it
+func truncateFile(fsys FS, path string, size int64) error {
+	f, err := fsys.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
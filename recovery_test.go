@@ -0,0 +1,220 @@
+package memorylanedb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestTornWriteRecovery(t *testing.T) {
+	assert := assert2.New(t)
+
+	// setup writes two keys and returns the path of the active datafile and
+	// its size before the second key was written
+	setup := func(t *testing.T, directory string) (string, int64) {
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		assert.NoError(db.Put("foo", []byte("bar")))
+		size := db.activeDataFile.Size()
+		assert.NoError(db.Put("baz", []byte("qux")))
+		path := filepath.Join(directory, db.activeDataFile.Name())
+		assert.NoError(db.Close())
+		return path, size
+	}
+	reopen := func(t *testing.T, directory, path string, size int64) {
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		value, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		_, err = db.Get("baz")
+		assert.ErrorIs(err, ErrKeyNotFound)
+
+		stat, err := os.Stat(path)
+		assert.NoError(err)
+		assert.Equal(size, stat.Size())
+		// the truncated file is still the active one
+		assert.NoError(db.Put("new", []byte("value")))
+		assert.Equal(filepath.Base(path), db.activeDataFile.Name())
+	}
+
+	t.Run("TruncatedEntry", func(t *testing.T) {
+		directory := t.TempDir()
+		path, size := setup(t, directory)
+		stat, err := os.Stat(path)
+		assert.NoError(err)
+		assert.NoError(os.Truncate(path, stat.Size()-2))
+		reopen(t, directory, path, size)
+	})
+
+	t.Run("ChecksumFailure", func(t *testing.T) {
+		directory := t.TempDir()
+		path, size := setup(t, directory)
+		buf, err := os.ReadFile(path)
+		assert.NoError(err)
+		buf[len(buf)-1] ^= 0xff
+		assert.NoError(os.WriteFile(path, buf, 0600))
+		reopen(t, directory, path, size)
+	})
+
+	t.Run("ZeroFilledTail", func(t *testing.T) {
+		directory := t.TempDir()
+		path, size := setup(t, directory)
+		// the file was extended but the entry never written
+		assert.NoError(os.Truncate(path, size))
+		assert.NoError(os.Truncate(path, size+64))
+		reopen(t, directory, path, size)
+	})
+
+	t.Run("TornHeader", func(t *testing.T) {
+		directory := t.TempDir()
+		path, _ := setup(t, directory)
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		db.mu.Lock()
+		assert.NoError(db.rotate())
+		db.mu.Unlock()
+		newest := filepath.Join(directory, db.activeDataFile.Name())
+		assert.NoError(db.Close())
+		assert.NoError(os.Truncate(newest, 3))
+
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		assert.Equal(filepath.Base(newest), db.activeDataFile.Name())
+		assert.NotEqual(filepath.Base(path), db.activeDataFile.Name())
+		value, err := db.Get("baz")
+		assert.NoError(err)
+		assert.Equal([]byte("qux"), value)
+	})
+
+	t.Run("OlderFileCorrupted", func(t *testing.T) {
+		directory := t.TempDir()
+		path, _ := setup(t, directory)
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		db.mu.Lock()
+		assert.NoError(db.rotate())
+		db.mu.Unlock()
+		assert.NoError(db.Close())
+
+		// only the newest datafile can hold a torn write
+		buf, err := os.ReadFile(path)
+		assert.NoError(err)
+		buf[len(buf)-1] ^= 0xff
+		assert.NoError(os.WriteFile(path, buf, 0600))
+		_, err = NewDB(directory, nil)
+		assert.ErrorIs(err, ErrCorruptedData)
+	})
+
+	t.Run("MidFileCorrupted", func(t *testing.T) {
+		directory := t.TempDir()
+		path, size := setup(t, directory)
+
+		// a valid entry follows the bad one, so it is no torn write
+		buf, err := os.ReadFile(path)
+		assert.NoError(err)
+		buf[size-1] ^= 0xff
+		assert.NoError(os.WriteFile(path, buf, 0600))
+		_, err = NewDB(directory, nil)
+		assert.ErrorIs(err, ErrCorruptedData)
+
+		stat, err := os.Stat(path)
+		assert.NoError(err)
+		assert.Equal(int64(len(buf)), stat.Size())
+	})
+}
+
+func TestHintfileFallback(t *testing.T) {
+	assert := assert2.New(t)
+
+	// setup returns a merged directory, the path of its hintfile and the
+	// stats it loads with
+	setup := func(t *testing.T) (string, string, map[string]any) {
+		directory := t.TempDir()
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		for i := 0; i < 10; i++ {
+			assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), []byte("value")))
+		}
+		assert.NoError(db.Put("key0", []byte("newer")))
+		assert.NoError(db.Merge(context.Background()))
+		assert.NoError(db.Close())
+
+		db, err = NewDB(directory, nil)
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		stats := db.Stats()
+		assert.NoError(db.Close())
+		hints, _ := filepath.Glob(filepath.Join(directory, "*"+HINTFILE_SUFFIX))
+		if !assert.Len(hints, 1) {
+			t.FailNow()
+		}
+		return directory, hints[0], stats
+	}
+	check := func(t *testing.T, directory string, stats map[string]any) {
+		db, err := NewDB(directory, nil)
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		for i := 0; i < 10; i++ {
+			value, err := db.Get(Key(fmt.Sprintf("key%d", i)))
+			assert.NoError(err)
+			if i == 0 {
+				assert.Equal([]byte("newer"), value)
+			} else {
+				assert.Equal([]byte("value"), value)
+			}
+		}
+		assert.Equal(stats, db.Stats())
+	}
+
+	t.Run("CorruptedHint", func(t *testing.T) {
+		directory, hintfile, stats := setup(t)
+		buf, err := os.ReadFile(hintfile)
+		assert.NoError(err)
+		// a byte of the first hint's key
+		buf[FILE_HEADER_SIZE+formats[CURRENT_FORMAT_VERSION].hintHeaderSize()] ^= 0xff
+		assert.NoError(os.WriteFile(hintfile, buf, 0600))
+		check(t, directory, stats)
+	})
+
+	t.Run("MissingFooter", func(t *testing.T) {
+		directory, hintfile, stats := setup(t)
+		stat, err := os.Stat(hintfile)
+		assert.NoError(err)
+		assert.NoError(os.Truncate(hintfile, stat.Size()-HINT_FOOTER_SIZE))
+		check(t, directory, stats)
+	})
+
+	t.Run("MissingHint", func(t *testing.T) {
+		directory, hintfile, stats := setup(t)
+		buf, err := os.ReadFile(hintfile)
+		assert.NoError(err)
+		// drop the last hint but keep the footer
+		footer := buf[len(buf)-HINT_FOOTER_SIZE:]
+		lastHint := formats[CURRENT_FORMAT_VERSION].hintHeaderSize() + int64(len("key9"))
+		buf = append(buf[:int64(len(buf))-HINT_FOOTER_SIZE-lastHint], footer...)
+		assert.NoError(os.WriteFile(hintfile, buf, 0600))
+		check(t, directory, stats)
+	})
+}
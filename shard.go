@@ -0,0 +1,162 @@
+package memorylanedb
+
+import "sync"
+
+/*
+	A sharded keyDir lets Get and Has run without the DB lock. Every shard has
+	its own lock: readers hold the read lock of their key's shard while they
+	look the key up and read its entry, writers still serialize on the DB lock
+	and only take a shard's write lock for the moment they change a key.
+
+	Readers holding a shard lock also rely on the set of open datafiles and on
+	closed, so whatever changes those (rotation, committing a merge, Close)
+	locks every shard first, see lockReaders.
+*/
+
+// shardedIndex splits the keys over hash partitioned shards. Unlike the other
+// indexes it is safe for concurrent use.
+type shardedIndex struct {
+	shards []indexShard
+}
+
+type indexShard struct {
+	mu   sync.RWMutex
+	keys hashIndex
+}
+
+func newShardedIndex(n int) *shardedIndex {
+	s := &shardedIndex{shards: make([]indexShard, n)}
+	for i := range s.shards {
+		s.shards[i].keys = hashIndex{}
+	}
+	return s
+}
+
+func (s *shardedIndex) shard(key Key) *indexShard {
+	return &s.shards[hashKey(key)%uint32(len(s.shards))]
+}
+
+func (s *shardedIndex) Get(key Key) (EntryItem, bool) {
+	shard := s.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return shard.keys.Get(key)
+}
+
+func (s *shardedIndex) Put(key Key, item EntryItem) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.keys.Put(key, item)
+}
+
+func (s *shardedIndex) Delete(key Key) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.keys.Delete(key)
+}
+
+func (s *shardedIndex) Len() int {
+	n := 0
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+		n += s.shards[i].keys.Len()
+		s.shards[i].mu.RUnlock()
+	}
+	return n
+}
+
+// Range visits the shards one after the other, fn runs holding the read lock
+// of the shard being visited and must not write to the index.
+func (s *shardedIndex) Range(fn func(key Key, item EntryItem) bool) {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.RLock()
+		more := true
+		shard.keys.Range(func(key Key, item EntryItem) bool {
+			more = fn(key, item)
+			return more
+		})
+		shard.mu.RUnlock()
+		if !more {
+			return
+		}
+	}
+}
+
+func (s *shardedIndex) Clone() index {
+	c := &shardedIndex{shards: make([]indexShard, len(s.shards))}
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+		c.shards[i].keys = s.shards[i].keys.Clone().(hashIndex)
+		s.shards[i].mu.RUnlock()
+	}
+	return c
+}
+
+// view runs fn with the shard of key read locked, passing it the entry of key
+func (s *shardedIndex) view(key Key, fn func(item EntryItem, ok bool) error) error {
+	shard := s.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	item, ok := shard.keys.Get(key)
+	return fn(item, ok)
+}
+
+func (s *shardedIndex) lockAll() {
+	for i := range s.shards {
+		s.shards[i].mu.Lock()
+	}
+}
+
+func (s *shardedIndex) unlockAll() {
+	for i := range s.shards {
+		s.shards[i].mu.Unlock()
+	}
+}
+
+// lockReaders waits for the readers of a sharded keyDir to finish and keeps
+// new ones out until the returned function is called. The keyDir must not be
+// used in between. Callers must hold mu.
+func (db *DB) lockReaders() func() {
+	s, ok := db.keyDir.(*shardedIndex)
+	if !ok {
+		return func() {}
+	}
+	s.lockAll()
+	return s.unlockAll
+}
+
+// getShared reads key from a sharded keyDir holding only its shard's lock
+func (db *DB) getShared(s *shardedIndex, key Key) ([]byte, error) {
+	var value []byte
+	err := s.view(key, func(item EntryItem, ok bool) error {
+		if db.closed {
+			return ErrDBClosed
+		}
+		if !ok || item.isExpired(db.now()) {
+			return ErrKeyNotFound
+		}
+		var err error
+		value, err = db.readCached(key, item, db.liveDatafile)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// hasShared is Has for a sharded keyDir, see getShared
+func (db *DB) hasShared(s *shardedIndex, key Key) (bool, error) {
+	var found bool
+	err := s.view(key, func(item EntryItem, ok bool) error {
+		if db.closed {
+			return ErrDBClosed
+		}
+		found = ok && !item.isExpired(db.now())
+		return nil
+	})
+	return found, err
+}
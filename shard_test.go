@@ -0,0 +1,170 @@
+package memorylanedb
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestShardedIndex(t *testing.T) {
+	assert := assert2.New(t)
+	rng := rand.New(rand.NewSource(1))
+
+	sharded := newShardedIndex(8)
+	reference := hashIndex{}
+	for i := 0; i < 20000; i++ {
+		key := Key(fmt.Sprintf("key%05d", rng.Intn(5000)))
+		if rng.Intn(3) == 0 {
+			sharded.Delete(key)
+			reference.Delete(key)
+			continue
+		}
+		item := EntryItem{entryOffset: uint64(i)}
+		sharded.Put(key, item)
+		reference.Put(key, item)
+	}
+	assert.Equal(reference.Len(), sharded.Len())
+
+	got := hashIndex{}
+	sharded.Range(func(key Key, item EntryItem) bool {
+		got[key] = item
+		return true
+	})
+	assert.Equal(reference, got)
+
+	t.Run("Clone", func(t *testing.T) {
+		clone := sharded.Clone()
+		reference.Range(func(key Key, _ EntryItem) bool {
+			sharded.Delete(key)
+			return true
+		})
+		assert.Equal(0, sharded.Len())
+		assert.Equal(reference.Len(), clone.Len())
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		_, err := NewDB(t.TempDir(), &Option{Index: INDEX_BTREE, IndexShards: 4})
+		assert.ErrorIs(err, ErrInvalidOption)
+		_, err = NewDB(t.TempDir(), &Option{IndexShards: -1})
+		assert.ErrorIs(err, ErrInvalidOption)
+	})
+}
+
+func TestShardedReads(t *testing.T) {
+	assert := assert2.New(t)
+	db, err := NewDB(t.TempDir(), &Option{IndexShards: 4, MaxKeySize: 64, MaxValueSize: 64, MaxDatafileSize: 4096})
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), []byte("value")))
+	}
+
+	// overwrites, rotations and merges must never hide a key from readers
+	var stop int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				for i := 0; i < 100; i++ {
+					value, err := db.Get(Key(fmt.Sprintf("key%d", i)))
+					assert.NoError(err)
+					assert.Equal([]byte("value"), value)
+					ok, err := db.Has(Key(fmt.Sprintf("key%d", i)))
+					assert.NoError(err)
+					assert.True(ok)
+				}
+			}
+		}()
+	}
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 100; i++ {
+			assert.NoError(db.Put(Key(fmt.Sprintf("key%d", i)), []byte("value")))
+		}
+		assert.NoError(db.Merge(context.Background()))
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+}
+
+// benchmarkLayouts compares the single lock keyDir with a sharded one
+var benchmarkLayouts = []struct {
+	name   string
+	shards int
+}{
+	{"SingleLock", 0},
+	{"Sharded", 32},
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, layout := range benchmarkLayouts {
+		b.Run(layout.name, func(b *testing.B) {
+			db := benchmarkDB(b, layout.shards)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					if _, err := db.Get(Key(fmt.Sprintf("key%d", rng.Intn(10000)))); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkGetWhileWriting measures reads while a single writer keeps
+// overwriting keys
+func BenchmarkGetWhileWriting(b *testing.B) {
+	for _, layout := range benchmarkLayouts {
+		b.Run(layout.name, func(b *testing.B) {
+			db := benchmarkDB(b, layout.shards)
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ctx.Err() == nil; i++ {
+					if err := db.Put(Key(fmt.Sprintf("key%d", i%10000)), []byte("value")); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					if _, err := db.Get(Key(fmt.Sprintf("key%d", rng.Intn(10000)))); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+			b.StopTimer()
+			cancel()
+			wg.Wait()
+		})
+	}
+}
+
+func benchmarkDB(b *testing.B, shards int) *DB {
+	db, err := NewDB(b.TempDir(), &Option{IndexShards: shards})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	for i := 0; i < 10000; i++ {
+		if err := db.Put(Key(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return db
+}
@@ -0,0 +1,154 @@
+package memorylanedb
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// Snapshot is a read-only, point-in-time view of the DB. Writes, deletes and
+// merges made after it was taken are not visible through it, and the
+// datafiles it reads from are kept until it is closed. A Snapshot must be
+// closed once it is no longer needed.
+type Snapshot struct {
+	db        *DB
+	keyDir    index
+	fileIDs   []int
+	createdAt time.Time
+	closed    bool // guarded by db.mu
+}
+
+// Snapshot captures the current keyDir. Taking a snapshot copies the keyDir,
+// so it costs time and memory proportional to the number of keys.
+func (db *DB) Snapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		// every read of it reports ErrDBClosed
+		return &Snapshot{db: db, closed: true}
+	}
+
+	return &Snapshot{
+		db:        db,
+		keyDir:    db.keyDir.Clone(),
+		fileIDs:   db.pinFiles(),
+		createdAt: db.now(),
+	}
+}
+
+// Get returns the value key had when the snapshot was taken. Expiry is
+// evaluated at that time as well.
+func (s *Snapshot) Get(key Key) ([]byte, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	if err := s.closedErr(); err != nil {
+		return nil, err
+	}
+	item, ok := s.keyDir.Get(key)
+	if !ok || item.isExpired(s.createdAt) {
+		return nil, ErrKeyNotFound
+	}
+	return s.db.readValue(key, item)
+}
+
+func (s *Snapshot) Has(key Key) (bool, error) {
+	if err := s.checkOpen(); err != nil {
+		return false, err
+	}
+	item, ok := s.keyDir.Get(key)
+	return ok && !item.isExpired(s.createdAt), nil
+}
+
+// Fold calls f for every key of the snapshot. The snapshot keyDir is never
+// modified, so f is called without holding any lock.
+func (s *Snapshot) Fold(f foldFunc) error {
+	if err := s.checkOpen(); err != nil {
+		return err
+	}
+	var err error
+	s.keyDir.Range(func(k Key, item EntryItem) bool {
+		if item.isExpired(s.createdAt) {
+			return true
+		}
+		err = f(k)
+		return err == nil
+	})
+	return err
+}
+
+func (s *Snapshot) checkOpen() error {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	return s.closedErr()
+}
+
+// closedErr reports whether the snapshot or its DB is closed; callers must
+// hold db.mu
+func (s *Snapshot) closedErr() error {
+	if s.db.closed {
+		return ErrDBClosed
+	}
+	if s.closed {
+		return ErrSnapshotClosed
+	}
+	return nil
+}
+
+// Close releases the datafiles pinned by the snapshot.
+func (s *Snapshot) Close() error {
+	db := s.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if db.closed {
+		// the DB closed every file already
+		return nil
+	}
+	return db.unpinFiles(s.fileIDs)
+}
+
+// pinFiles keeps every current datafile readable until unpinFiles, even if it
+// is merged away in the meantime; callers must hold mu
+func (db *DB) pinFiles() []int {
+	fileIDs := []int{db.activeDataFile.ID()}
+	for id := range db.immutableDataFiles {
+		fileIDs = append(fileIDs, id)
+	}
+	// values in the blob log are read through them
+	if db.activeBlobFile != nil {
+		fileIDs = append(fileIDs, db.activeBlobFile.ID())
+	}
+	for id := range db.blobFiles {
+		fileIDs = append(fileIDs, id)
+	}
+	for _, id := range fileIDs {
+		db.fileRefs[id]++
+	}
+	return fileIDs
+}
+
+// unpinFiles releases files pinned by pinFiles, removing the ones that were
+// merged away in the meantime; callers must hold mu
+func (db *DB) unpinFiles(fileIDs []int) error {
+	for _, id := range fileIDs {
+		db.fileRefs[id]--
+		if db.fileRefs[id] > 0 {
+			continue
+		}
+		delete(db.fileRefs, id)
+		df, ok := db.obsoleteFiles[id]
+		if !ok {
+			continue
+		}
+		delete(db.obsoleteFiles, id)
+		if err := df.Close(); err != nil {
+			return err
+		}
+		if err := db.fs.Remove(filepath.Join(db.path, OBSOLETE_DIRNAME, df.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
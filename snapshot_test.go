@@ -0,0 +1,73 @@
+package memorylanedb
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	db, err := NewDB(directory, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+	assert.NoError(db.Put("foo", []byte("bar")))
+	assert.NoError(db.Put("baz", []byte("qux")))
+
+	snap := db.Snapshot()
+	assert.NoError(db.Put("foo", []byte("changed")))
+	assert.NoError(db.Delete("baz"))
+	assert.NoError(db.Put("new", []byte("key")))
+
+	check := func() {
+		value, err := snap.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		value, err = snap.Get("baz")
+		assert.NoError(err)
+		assert.Equal([]byte("qux"), value)
+		ok, err := snap.Has("new")
+		assert.NoError(err)
+		assert.False(ok)
+
+		var keys []string
+		assert.NoError(snap.Fold(func(k Key) error {
+			keys = append(keys, string(k))
+			return nil
+		}))
+		sort.Strings(keys)
+		assert.Equal([]string{"baz", "foo"}, keys)
+	}
+
+	t.Run("IsolatedFromWrites", func(t *testing.T) {
+		check()
+	})
+
+	t.Run("IsolatedFromMerge", func(t *testing.T) {
+		assert.NoError(db.Merge(context.Background()))
+		check()
+		// the merged away datafile is kept for the snapshot
+		retired, _ := filepath.Glob(filepath.Join(directory, OBSOLETE_DIRNAME, "*"))
+		assert.Len(retired, 1)
+
+		value, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("changed"), value)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		assert.NoError(snap.Close())
+		retired, _ := filepath.Glob(filepath.Join(directory, OBSOLETE_DIRNAME, "*"))
+		assert.Len(retired, 0)
+		_, err := snap.Get("foo")
+		assert.ErrorIs(err, ErrSnapshotClosed)
+		assert.NoError(snap.Close())
+	})
+}
@@ -1,5 +1,8 @@
 package memorylanedb
 
+import "time"
+
+// default size limits, see Option
 const (
 	MAX_KEY_SIZE       = 512
 	MAX_VALUE_SIZE     = 1024 * 1024 * 2   // 2MB
@@ -15,7 +18,13 @@ func (k Key) length() int {
 
 type EntryItem struct {
 	fileId      uint
-	entrySize   uint32
-	entryOffset uint32 // 32-bit, max offset of 2^32
+	entrySize   uint64
+	entryOffset uint64
 	tstamp      uint32
+	expiry      uint32 // 0 never expires
+	seq         uint64 // bumped whenever the key is written, see Txn
+}
+
+func (item EntryItem) isExpired(now time.Time) bool {
+	return isExpired(item.expiry, now)
 }
@@ -0,0 +1,68 @@
+package memorylanedb
+
+// DatafileStats is the byte accounting of a single datafile. Live bytes are
+// entries the keyDir points at; dead bytes are overwritten or deleted entries
+// and tombstones, which a merge reclaims.
+type DatafileStats struct {
+	ID        int
+	LiveBytes int64
+	DeadBytes int64
+}
+
+// statsFor returns the accounting of a datafile, creating it if needed;
+// callers must hold mu
+func (db *DB) statsFor(fileId uint) *DatafileStats {
+	st, ok := db.fileStats[int(fileId)]
+	if !ok {
+		st = &DatafileStats{ID: int(fileId)}
+		db.fileStats[int(fileId)] = st
+	}
+	return st
+}
+
+// setKey points key at item, the entry it replaces becomes dead; callers must
+// hold mu
+func (db *DB) setKey(key Key, item EntryItem) {
+	db.seq++
+	item.seq = db.seq
+	db.replaceKey(key, item)
+}
+
+// relocateKey points key at a copy of its current entry, the key keeps its
+// sequence number; callers must hold mu
+func (db *DB) relocateKey(key Key, item EntryItem) {
+	old, _ := db.keyDir.Get(key)
+	item.seq = old.seq
+	db.replaceKey(key, item)
+}
+
+// replaceKey overwrites key in place, readers of a sharded keyDir never see it
+// missing
+func (db *DB) replaceKey(key Key, item EntryItem) {
+	db.killEntry(key)
+	db.keyDir.Put(key, item)
+	db.invalidateValue(key)
+	db.statsFor(item.fileId).LiveBytes += int64(item.entrySize)
+}
+
+// deleteKey removes key from the keyDir, its entry becomes dead; callers must
+// hold mu
+func (db *DB) deleteKey(key Key) {
+	if db.killEntry(key) {
+		db.keyDir.Delete(key)
+		db.invalidateValue(key)
+	}
+}
+
+// killEntry accounts the current entry of key as dead and reports whether
+// there was one; callers must hold mu
+func (db *DB) killEntry(key Key) bool {
+	old, ok := db.keyDir.Get(key)
+	if !ok {
+		return false
+	}
+	st := db.statsFor(old.fileId)
+	st.LiveBytes -= int64(old.entrySize)
+	st.DeadBytes += int64(old.entrySize)
+	return true
+}
@@ -0,0 +1,387 @@
+package memorylanedb
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// STAGING_DIRNAME holds the values PutReader is still reading from its
+// caller, so that the DB is not locked while they arrive
+const STAGING_DIRNAME = "staging"
+
+var stagedValueName = "%d.value"
+
+// PutReader stores a value of size bytes read from r under key, streaming it
+// into the DB instead of holding it in memory. The value is not compressed
+// until a merge copies it. If r fails or ends early nothing is stored.
+//
+// r is drained without holding the DB lock, so reads and other writes carry
+// on meanwhile. A value over Option.BlobThreshold is staged as a blob file of
+// its own that is then moved into the DB, any other value is staged in a
+// file of the staging directory and copied into the active datafile. An
+// encrypted DB holds the latter in memory instead, as a staging file would
+// keep it in plaintext. A blob file is sealed as it is written, but a value
+// is sealed whole, so that reads it into memory as well.
+func (db *DB) PutReader(key Key, r io.Reader, size int64) error {
+	if err := db.validateKey(key); err != nil {
+		return err
+	}
+	if size < 0 || size > int64(db.maxValueSize) {
+		return ErrValueGreaterThanMax
+	}
+	// fail before reading the value rather than after
+	if err := db.writable(); err != nil {
+		return err
+	}
+	entry := NewEntry([]byte(key), nil)
+	entry.ValueSize = uint32(size)
+	if db.separates(size) {
+		return db.putBlobFrom(entry, r, size)
+	}
+
+	staged, unstage, err := db.stageValue(r, size)
+	if err != nil {
+		return err
+	}
+	defer unstage()
+	return db.update(func() error {
+		entrySize := entry.HeaderSize() + int64(entry.KeySize) + size
+		if err := db.rotateActiveFile(entrySize); err != nil {
+			return err
+		}
+		if _, err := staged.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		offset_before_write, bytesWritten, err := db.activeDataFile.WriteFrom(entry, staged)
+		if err != nil {
+			return err
+		}
+		db.appended++
+		_, entryItem := entry.produceRecord(db.activeDataFile.ID(), uint64(offset_before_write), uint64(bytesWritten))
+		db.setKey(key, entryItem)
+		return nil
+	})
+}
+
+// stagingDir creates the staging directory and returns its path
+func (db *DB) stagingDir() (string, error) {
+	dir := filepath.Join(db.path, STAGING_DIRNAME)
+	return dir, db.fs.MkdirAll(dir, fs.ModeDir|fs.ModePerm)
+}
+
+// stageValue copies a value of size bytes from r into a staging file, and
+// returns it along with a function that removes it. An encrypted DB never
+// writes the plaintext value to disk, it stages it in memory.
+func (db *DB) stageValue(r io.Reader, size int64) (io.ReadSeeker, func(), error) {
+	if db.keys != nil {
+		value, err := readBytes(r, size)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return bytes.NewReader(value), func() {}, nil
+	}
+	dir, err := db.stagingDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	path := filepath.Join(dir, fmt.Sprintf(stagedValueName, atomic.AddUint64(&db.staged, 1)))
+	f, err := db.fs.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	unstage := func() {
+		f.Close()
+		db.fs.Remove(path)
+	}
+	if _, err := io.CopyN(f, r, size); err != nil {
+		unstage()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	return f, unstage, nil
+}
+
+// putBlobFrom streams a value of size bytes from r into a staged blob file of
+// its own, then moves that into the DB and appends entry pointing to it. Only
+// the latter holds mu.
+func (db *DB) putBlobFrom(entry Entry, r io.Reader, size int64) error {
+	dir, err := db.stagingDir()
+	if err != nil {
+		return err
+	}
+	id := db.reserveFileID()
+	staged := filepath.Join(dir, fmt.Sprintf(blobfileDefaultName, id))
+	bf, err := NewDatafile(dir, id, db.fileOptions(AsBlobFile())...)
+	if err != nil {
+		return err
+	}
+	blob := NewEntry(entry.Key, nil)
+	blob.ValueSize = uint32(size)
+	offset, n, err := bf.WriteFrom(blob, r)
+	// closing syncs the blob file, it is complete before anything points to it
+	if closeErr := bf.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		db.fs.Remove(staged)
+		return err
+	}
+	entry.pointTo(blobPointer{uint32(id), uint64(offset), uint64(n)})
+
+	adopted := false
+	err = db.update(func() error {
+		if err := db.adoptBlobFile(dir, id); err != nil {
+			return err
+		}
+		adopted = true
+		entryItem, err := db.put(entry)
+		if err != nil {
+			return err
+		}
+		db.setKey(Key(entry.Key), entryItem)
+		return nil
+	})
+	if !adopted {
+		db.fs.Remove(staged)
+	}
+	return err
+}
+
+// adoptBlobFile moves the complete blob file id from dir into the DB as an
+// immutable one; callers must hold mu
+func (db *DB) adoptBlobFile(dir string, id int) error {
+	name := fmt.Sprintf(blobfileDefaultName, id)
+	if err := db.fs.Rename(filepath.Join(dir, name), filepath.Join(db.path, name)); err != nil {
+		return err
+	}
+	if err := db.fs.SyncDir(db.path); err != nil {
+		return err
+	}
+	bf, err := NewDatafile(db.path, id, append(db.readOnlyOptions(), AsBlobFile())...)
+	if err != nil {
+		return err
+	}
+	defer db.lockReaders()()
+	db.blobFiles[id] = bf
+	return nil
+}
+
+// GetReader returns a reader over the value of key that streams it from its
+// datafile, decompressing it on the way. The value is the one current when
+// GetReader is called, later writes and merges do not affect it. A checksum
+// mismatch is reported by Read once the end of the value is reached, as
+// ErrCorruptedData. An encrypted value is read and authenticated whole by
+// GetReader instead. The reader must be closed.
+func (db *DB) GetReader(key Key) (io.ReadCloser, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+	item, ok := db.keyDir.Get(key)
+	if !ok || item.isExpired(db.now()) {
+		return nil, ErrKeyNotFound
+	}
+	df, ok := db.datafile(int(item.fileId))
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	vr, entry, err := db.newValueReader(df, key, item.entryOffset, item.entrySize)
+	if err != nil {
+		return nil, err
+	}
+	if entry.IsBlobPointer() {
+		// a pointer is small enough to read whole
+		pointer, _, err := df.ReadFrom(item.entryOffset, item.entrySize)
+		if err != nil {
+			return nil, err
+		}
+		p, err := decodeBlobPointer(pointer.Value)
+		if err != nil {
+			return nil, err
+		}
+		bf, ok := db.datafile(int(p.fileId))
+		if !ok {
+			return nil, ErrCorruptedData
+		}
+		if vr, entry, err = db.newValueReader(bf, key, p.offset, p.size); err != nil {
+			return nil, err
+		}
+	}
+	if id := entry.Compressor(); id != COMPRESSOR_NONE {
+		if _, ok := db.compressors[id]; !ok {
+			return nil, ErrUnknownCompressor
+		}
+		db.fileRefs[vr.fileID]++
+		return &decompressingReader{db: db, id: id, vr: vr}, nil
+	}
+	db.fileRefs[vr.fileID]++
+	return vr, nil
+}
+
+// newValueReader decodes the prefix and key of the entry of key at offset in
+// df and returns a reader over its value; callers must hold mu
+func (db *DB) newValueReader(df Datafile, key Key, offset, size uint64) (*valueReader, Entry, error) {
+	if df.KeyID() != 0 {
+		return db.newSealedValueReader(df, key, offset, size)
+	}
+	codec := NewReaderCodec(nil, df.Version())
+	prefixSize := codec.entryHeaderSize()
+	prefix := make([]byte, prefixSize+int64(len(key)))
+	if _, err := df.ReadAt(prefix, int64(offset)); err != nil {
+		return nil, Entry{}, err
+	}
+	var entry Entry
+	if err := codec.decodeEntryPrefix(prefix, &entry); err != nil {
+		return nil, Entry{}, err
+	}
+	entryKey := prefix[prefixSize:]
+	if int(entry.KeySize) != len(key) || !bytes.Equal(entryKey, []byte(key)) ||
+		uint64(prefixSize)+uint64(entry.KeySize)+uint64(entry.ValueSize) != size {
+		return nil, Entry{}, ErrCorruptedData
+	}
+	return &valueReader{
+		db:        db,
+		fileID:    df.ID(),
+		offset:    int64(offset) + int64(len(prefix)),
+		remaining: int64(entry.ValueSize),
+		crc:       codec.checksumStart(prefix[:prefixSize], entryKey),
+		expected:  entry.Checksum,
+	}, entry, nil
+}
+
+// newSealedValueReader decrypts the entry of key at offset in the encrypted df
+// and returns a reader over its value; callers must hold mu
+func (db *DB) newSealedValueReader(df Datafile, key Key, offset, size uint64) (*valueReader, Entry, error) {
+	entry, _, err := df.ReadFrom(offset, size)
+	if err != nil {
+		return nil, Entry{}, err
+	}
+	if !bytes.Equal(entry.Key, []byte(key)) {
+		return nil, Entry{}, ErrCorruptedData
+	}
+	return &valueReader{
+		db:        db,
+		fileID:    df.ID(),
+		remaining: int64(len(entry.Value)),
+		value:     entry.Value,
+	}, entry, nil
+}
+
+// valueReader reads a value straight from its datafile, which it keeps pinned
+// until it is closed
+type valueReader struct {
+	db        *DB
+	fileID    int
+	offset    int64
+	remaining int64
+	crc       uint32
+	expected  uint32
+	value     []byte // the decrypted value of an encrypted entry, read instead of the file
+	closed    bool   // guarded by db.mu
+}
+
+func (vr *valueReader) Read(p []byte) (int, error) {
+	db := vr.db
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0, ErrDBClosed
+	}
+	if vr.closed {
+		return 0, ErrReaderClosed
+	}
+	if vr.remaining == 0 {
+		if vr.crc != vr.expected {
+			return 0, ErrCorruptedData
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > vr.remaining {
+		p = p[:vr.remaining]
+	}
+	if vr.value != nil {
+		n := copy(p, vr.value[int64(len(vr.value))-vr.remaining:])
+		vr.remaining -= int64(n)
+		return n, nil
+	}
+	// the file is looked up on every read, rotation and merges reopen or
+	// retire it but keep its id
+	df, ok := db.datafile(vr.fileID)
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	n, err := df.ReadAt(p, vr.offset)
+	vr.crc = crc32.Update(vr.crc, crc32.IEEETable, p[:n])
+	vr.offset += int64(n)
+	vr.remaining -= int64(n)
+	if err == io.EOF {
+		if vr.remaining > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// Close releases the datafile of the value.
+func (vr *valueReader) Close() error {
+	db := vr.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if vr.closed {
+		return nil
+	}
+	vr.closed = true
+	if db.closed {
+		// the DB closed every file already
+		return nil
+	}
+	return db.unpinFiles([]int{vr.fileID})
+}
+
+// decompressingReader decompresses a value while it is read. The decompressor
+// is only created by the first Read since it starts reading the value.
+type decompressingReader struct {
+	db *DB
+	id uint8
+	vr *valueReader
+	r  io.ReadCloser
+}
+
+func (dr *decompressingReader) Read(p []byte) (int, error) {
+	if dr.r == nil {
+		r, err := dr.db.decompressor(dr.id, dr.vr)
+		if err != nil {
+			return 0, err
+		}
+		dr.r = r
+	}
+	n, err := dr.r.Read(p)
+	if err == io.EOF {
+		// the decompressor may stop short of the end of the value, where
+		// its checksum is verified
+		if _, drainErr := io.Copy(io.Discard, dr.vr); drainErr != nil {
+			err = drainErr
+		}
+	}
+	return n, err
+}
+
+func (dr *decompressingReader) Close() error {
+	if dr.r != nil {
+		dr.r.Close()
+	}
+	return dr.vr.Close()
+}
@@ -0,0 +1,168 @@
+package memorylanedb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestStreaming(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+	db, err := NewDB(directory, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+
+	value := make([]byte, MAX_VALUE_SIZE)
+	rand.New(rand.NewSource(1)).Read(value)
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		assert.NoError(db.PutReader("large", bytes.NewReader(value), int64(len(value))))
+		got, err := db.Get("large")
+		assert.NoError(err)
+		assert.Equal(value, got)
+
+		r, err := db.GetReader("large")
+		if !assert.NoError(err) {
+			return
+		}
+		streamed, err := io.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(value, streamed)
+		assert.NoError(r.Close())
+		_, err = r.Read(make([]byte, 1))
+		assert.ErrorIs(err, ErrReaderClosed)
+	})
+
+	t.Run("ShortReader", func(t *testing.T) {
+		assert.NoError(db.Put("short", []byte("before")))
+		size := db.activeDataFile.Size()
+		err := db.PutReader("short", bytes.NewReader(value[:100]), 200)
+		assert.ErrorIs(err, io.ErrUnexpectedEOF)
+		assert.Equal(size, db.activeDataFile.Size())
+
+		got, err := db.Get("short")
+		assert.NoError(err)
+		assert.Equal([]byte("before"), got)
+		assert.NoError(db.Put("after", []byte("value")))
+		got, err = db.Get("after")
+		assert.NoError(err)
+		assert.Equal([]byte("value"), got)
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		assert.ErrorIs(db.PutReader("big", bytes.NewReader(nil), MAX_VALUE_SIZE+1), ErrValueGreaterThanMax)
+		assert.ErrorIs(db.PutReader("", bytes.NewReader(nil), 0), ErrKeyZeroLength)
+		_, err := db.GetReader("missing")
+		assert.ErrorIs(err, ErrKeyNotFound)
+	})
+
+	t.Run("SurvivesMerge", func(t *testing.T) {
+		r, err := db.GetReader("large")
+		if !assert.NoError(err) {
+			return
+		}
+		head := make([]byte, 1000)
+		_, err = io.ReadFull(r, head)
+		assert.NoError(err)
+
+		assert.NoError(db.Put("large", []byte("replaced")))
+		assert.NoError(db.Merge(context.Background()))
+
+		rest, err := io.ReadAll(r)
+		assert.NoError(err)
+		assert.Equal(value, append(head, rest...))
+		assert.NoError(r.Close())
+		retired, _ := filepath.Glob(filepath.Join(directory, OBSOLETE_DIRNAME, "*"))
+		assert.Len(retired, 0)
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		assert.NoError(db.PutReader("corrupt", bytes.NewReader(value[:4096]), 4096))
+		item, _ := db.keyDir.Get("corrupt")
+		df := db.activeDataFile
+		f, err := os.OpenFile(filepath.Join(directory, df.Name()), os.O_RDWR, 0)
+		if !assert.NoError(err) {
+			return
+		}
+		_, err = f.WriteAt([]byte{^value[100]}, int64(item.entryOffset+item.entrySize)-4096+100)
+		assert.NoError(err)
+		assert.NoError(f.Close())
+
+		r, err := db.GetReader("corrupt")
+		if !assert.NoError(err) {
+			return
+		}
+		defer r.Close()
+		_, err = io.ReadAll(r)
+		assert.True(errors.Is(err, ErrCorruptedData))
+	})
+
+	t.Run("ReadsWhileStreaming", func(t *testing.T) {
+		// the value is staged in a datafile entry and in a blob file
+		for _, opts := range []*Option{nil, {BlobThreshold: 64}} {
+			db, err := NewDB(t.TempDir(), opts)
+			if !assert.NoError(err) {
+				return
+			}
+			assert.NoError(db.Put("key", []byte("value")))
+
+			pr, pw := io.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				done <- db.PutReader("streamed", pr, 4096)
+			}()
+			_, err = pw.Write(value[:1024])
+			assert.NoError(err)
+
+			// PutReader is waiting for the rest of the value
+			reads := make(chan error, 1)
+			go func() {
+				_, err := db.Get("key")
+				if err == nil {
+					err = db.Put("other", []byte("value"))
+				}
+				reads <- err
+			}()
+			select {
+			case err := <-reads:
+				assert.NoError(err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("PutReader blocked the DB while reading its value")
+			}
+
+			_, err = pw.Write(value[1024:4096])
+			assert.NoError(err)
+			assert.NoError(pw.Close())
+			assert.NoError(<-done)
+			got, err := db.Get("streamed")
+			assert.NoError(err)
+			assert.Equal(value[:4096], got)
+			assert.NoError(db.Close())
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		r, err := db.GetReader("after")
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(db.Close())
+		_, err = r.Read(make([]byte, 1))
+		assert.ErrorIs(err, ErrDBClosed)
+		assert.NoError(r.Close())
+		_, err = db.GetReader("after")
+		assert.ErrorIs(err, ErrDBClosed)
+		assert.ErrorIs(db.PutReader("after", bytes.NewReader(nil), 0), ErrDBClosed)
+	})
+}
@@ -0,0 +1,174 @@
+package memorylanedb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SyncMode decides when writes are fsynced to disk. Whatever the mode, Close
+// and rotating the active file sync everything written before.
+type SyncMode int
+
+const (
+	// SYNC_NEVER leaves flushing to the OS, a crash can lose any write that
+	// was not synced by DB.Sync
+	SYNC_NEVER SyncMode = iota
+	// SYNC_ALWAYS fsyncs before every write returns
+	SYNC_ALWAYS
+	// SYNC_GROUP fsyncs before every write returns, but writers that are
+	// waiting at the same time share a single fsync
+	SYNC_GROUP
+	// SYNC_INTERVAL fsyncs every Option.SyncInterval from a background
+	// goroutine, a crash loses at most the writes of the last interval
+	SYNC_INTERVAL
+)
+
+// groupSync lets concurrent writers wait for a shared fsync. Writes are
+// numbered by DB.appended; a writer waits until synced covers its number and,
+// if no sync is running, runs one for everyone appended so far.
+type groupSync struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	synced  uint64
+	syncing bool
+}
+
+// Sync flushes the active datafile to disk.
+//
+// A failed sync makes the DB read-only: the writes it covered may or may not
+// be on disk and a later fsync can succeed without having written them, so
+// it is never retried. From then on Sync and every write return the error of
+// the failed sync, while reads keep working. Reopening the DB reads back
+// whatever did reach the disk.
+func (db *DB) Sync() error {
+	_, err := db.syncAppended()
+	return err
+}
+
+// syncAppended fsyncs the active file and returns the number of the last
+// append it covers. Earlier datafiles were synced when they were rotated.
+func (db *DB) syncAppended() (uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return 0, ErrDBClosed
+	}
+	return db.appended, db.syncActive()
+}
+
+// syncActive fsyncs the active blob file and then the active datafile, whose
+// pointers refer to it; callers must hold mu
+func (db *DB) syncActive() error {
+	if err := db.failure(); err != nil {
+		return err
+	}
+	if db.activeBlobFile != nil {
+		if err := db.activeBlobFile.Sync(); err != nil {
+			return db.fail(err)
+		}
+	}
+	if err := db.activeDataFile.Sync(); err != nil {
+		return db.fail(err)
+	}
+	return nil
+}
+
+// fail makes the DB read-only after err failed a sync and returns the error
+// of the first failed sync
+func (db *DB) fail(err error) error {
+	db.failMu.Lock()
+	defer db.failMu.Unlock()
+	if db.failed == nil {
+		log.Error().Err(err).Str("path", db.path).Msg("sync failed, the database is read-only")
+		db.failed = err
+	}
+	return db.failed
+}
+
+// failure returns the error that made the DB read-only, nil while it is
+// writable
+func (db *DB) failure() error {
+	db.failMu.Lock()
+	defer db.failMu.Unlock()
+	return db.failed
+}
+
+// writable returns the error a write would fail with, nil if it would not
+func (db *DB) writable() error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ErrDBClosed
+	}
+	return db.failure()
+}
+
+// update runs fn, which appends to the active file, holding mu and then makes
+// the appended entries durable as the sync mode asks
+func (db *DB) update(fn func() error) error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrDBClosed
+	}
+	if err := db.failure(); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	before := db.appended
+	err := fn()
+	appended := db.appended
+	if err == nil && appended != before && db.syncMode == SYNC_ALWAYS {
+		err = db.syncActive()
+	}
+	db.mu.Unlock()
+	if err != nil || appended == before || db.syncMode != SYNC_GROUP {
+		return err
+	}
+	return db.waitSync(appended)
+}
+
+// waitSync blocks until the append numbered n is on disk
+func (db *DB) waitSync(n uint64) error {
+	g := &db.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.synced < n {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		g.mu.Unlock()
+		synced, err := db.syncAppended()
+		g.mu.Lock()
+		g.syncing = false
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if synced > g.synced {
+			g.synced = synced
+		}
+	}
+	return nil
+}
+
+func (db *DB) runSyncer(ctx context.Context) {
+	defer db.wg.Done()
+	ticker := time.NewTicker(db.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := db.Sync(); err != nil {
+				log.Error().Err(err).Str("path", db.path).Msg("scheduled sync failed")
+			}
+		}
+	}
+}
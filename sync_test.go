@@ -0,0 +1,67 @@
+package memorylanedb
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestSyncModes(t *testing.T) {
+	assert := assert2.New(t)
+
+	t.Run("Validation", func(t *testing.T) {
+		_, err := NewDB(t.TempDir(), &Option{SyncMode: SYNC_INTERVAL})
+		assert.ErrorIs(err, ErrInvalidOption)
+		_, err = NewDB(t.TempDir(), &Option{SyncMode: SyncMode(42)})
+		assert.ErrorIs(err, ErrInvalidOption)
+
+		db, err := NewDB(t.TempDir(), &Option{SyncOnWrite: true})
+		if !assert.NoError(err) {
+			return
+		}
+		defer db.Close()
+		assert.Equal(SYNC_ALWAYS, db.syncMode)
+	})
+
+	for _, opts := range []*Option{
+		{SyncMode: SYNC_NEVER},
+		{SyncMode: SYNC_ALWAYS},
+		{SyncMode: SYNC_GROUP},
+		{SyncMode: SYNC_INTERVAL, SyncInterval: time.Millisecond},
+	} {
+		opts := opts
+		t.Run(fmt.Sprintf("Mode%d", opts.SyncMode), func(t *testing.T) {
+			directory := t.TempDir()
+			db, err := NewDB(directory, opts)
+			if !assert.NoError(err) {
+				return
+			}
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 20; j++ {
+						assert.NoError(db.Put(Key(fmt.Sprintf("key%d-%d", i, j)), []byte("value")))
+					}
+				}(i)
+			}
+			wg.Wait()
+			assert.NoError(db.Sync())
+			if opts.SyncMode == SYNC_GROUP {
+				assert.Equal(db.appended, db.group.synced)
+			}
+			assert.NoError(db.Close())
+
+			db, err = NewDB(directory, opts)
+			if !assert.NoError(err) {
+				return
+			}
+			defer db.Close()
+			assert.Equal(160, db.Stats()["keys"])
+		})
+	}
+}
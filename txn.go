@@ -0,0 +1,124 @@
+package memorylanedb
+
+/*
+	Transactions are optimistic: reads go to the DB as of the time they are
+	made and writes are buffered in the Txn. On Commit the sequence number of
+	every key the transaction read is checked against the keyDir, if any of
+	them was written since, the transaction fails with ErrTxnConflict and
+	nothing is written. Otherwise the buffered writes are applied as a single
+	WriteBatch, under the same lock as the check.
+*/
+
+// Txn is a read-write transaction, created by DB.Begin. A Txn is not safe for
+// concurrent use, run one per goroutine.
+type Txn struct {
+	db     *DB
+	reads  map[Key]uint64 // sequence number seen by the first read, 0 if absent
+	writes map[Key]batchOp
+	batch  *WriteBatch
+	done   bool
+}
+
+func (db *DB) Begin() *Txn {
+	return &Txn{
+		db:     db,
+		reads:  make(map[Key]uint64),
+		writes: make(map[Key]batchOp),
+		batch:  NewWriteBatch(),
+	}
+}
+
+// Get returns the value of key, including writes made earlier in the
+// transaction.
+func (txn *Txn) Get(key Key) ([]byte, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+	if op, ok := txn.writes[key]; ok {
+		if op.delete {
+			return nil, ErrKeyNotFound
+		}
+		return op.value, nil
+	}
+	txn.db.mu.RLock()
+	value, seq, err := txn.db.get(key)
+	txn.db.mu.RUnlock()
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+	if _, ok := txn.reads[key]; !ok {
+		txn.reads[key] = seq
+	}
+	return value, err
+}
+
+func (txn *Txn) Put(key Key, value []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if err := txn.db.validateKey(key); err != nil {
+		return err
+	}
+	if len(value) > int(txn.db.maxValueSize) {
+		return ErrValueGreaterThanMax
+	}
+	txn.batch.Put(key, value)
+	txn.writes[key] = batchOp{key: key, value: value}
+	return nil
+}
+
+func (txn *Txn) Delete(key Key) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if err := txn.db.validateKey(key); err != nil {
+		return err
+	}
+	txn.batch.Delete(key)
+	txn.writes[key] = batchOp{key: key, delete: true}
+	return nil
+}
+
+// Commit applies the writes of the transaction atomically, unless a key it
+// read has been written since, in which case ErrTxnConflict is returned.
+// The transaction is finished either way.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+	db := txn.db
+
+	var entries []Entry
+	if txn.batch.Len() > 0 {
+		var err error
+		if entries, err = db.batchEntries(txn.batch); err != nil {
+			return err
+		}
+	}
+
+	return db.update(func() error {
+		now := db.now()
+		for key, seq := range txn.reads {
+			var current uint64
+			if item, ok := db.keyDir.Get(key); ok && !item.isExpired(now) {
+				current = item.seq
+			}
+			if current != seq {
+				return ErrTxnConflict
+			}
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		return db.writeBatch(entries)
+	})
+}
+
+// Rollback discards the transaction, it is a no-op after Commit.
+func (txn *Txn) Rollback() {
+	txn.done = true
+	txn.reads = nil
+	txn.writes = nil
+	txn.batch = nil
+}
@@ -0,0 +1,128 @@
+package memorylanedb
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	assert2 "github.com/stretchr/testify/assert"
+)
+
+func TestTxn(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	db, err := NewDB(directory, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+	assert.NoError(db.Put("foo", []byte("bar")))
+
+	t.Run("Commit", func(t *testing.T) {
+		txn := db.Begin()
+		value, err := txn.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+		assert.NoError(txn.Put("foo", []byte("baz")))
+		assert.NoError(txn.Delete("qux"))
+
+		// writes are visible to the transaction only
+		value, err = txn.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("baz"), value)
+		value, err = db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), value)
+
+		assert.NoError(txn.Commit())
+		value, err = db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("baz"), value)
+		assert.ErrorIs(txn.Commit(), ErrTxnDone)
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		txn := db.Begin()
+		_, err := txn.Get("foo")
+		assert.NoError(err)
+		_, err = txn.Get("absent")
+		assert.ErrorIs(err, ErrKeyNotFound)
+		assert.NoError(txn.Put("foo", []byte("txn")))
+
+		assert.NoError(db.Put("absent", []byte("now present")))
+		assert.ErrorIs(txn.Commit(), ErrTxnConflict)
+		value, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("baz"), value)
+	})
+
+	t.Run("MergeIsNotAConflict", func(t *testing.T) {
+		txn := db.Begin()
+		_, err := txn.Get("foo")
+		assert.NoError(err)
+		assert.NoError(db.Merge(context.Background()))
+		assert.NoError(txn.Put("foo", []byte("merged")))
+		assert.NoError(txn.Commit())
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		txn := db.Begin()
+		assert.NoError(txn.Put("foo", []byte("rolledback")))
+		txn.Rollback()
+		assert.ErrorIs(txn.Commit(), ErrTxnDone)
+		value, err := db.Get("foo")
+		assert.NoError(err)
+		assert.Equal([]byte("merged"), value)
+	})
+}
+
+func TestTxnConcurrentIncrements(t *testing.T) {
+	assert := assert2.New(t)
+	directory := t.TempDir()
+
+	db, err := NewDB(directory, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	defer db.Close()
+	assert.NoError(db.Put("counter", []byte("0")))
+
+	increment := func() error {
+		for {
+			txn := db.Begin()
+			value, err := txn.Get("counter")
+			if err != nil {
+				return err
+			}
+			n, err := strconv.Atoi(string(value))
+			if err != nil {
+				return err
+			}
+			if err := txn.Put("counter", []byte(strconv.Itoa(n+1))); err != nil {
+				return err
+			}
+			err = txn.Commit()
+			if err != ErrTxnConflict {
+				return err
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				assert.NoError(increment())
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := db.Get("counter")
+	assert.NoError(err)
+	assert.Equal("200", string(value))
+}
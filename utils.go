@@ -14,14 +14,18 @@ type Iterator[T any] interface {
 
 func extractIDFromFilename(filename string) (int, error) {
 	basefn := filepath.Base(filename)
-	ext := filepath.Ext(basefn)
-	if !Contains(ext, []string{DATAFILE_SUFFIX, MERGED_DATAFILE_SUFFIX, HINTFILE_SUFFIX}) {
-		return -1, errors.New("invalid file extension")
+	// filepath.Ext only sees ".merged" for merged datafiles, so match on the
+	// full suffixes instead
+	for _, suffix := range []string{MERGED_DATAFILE_SUFFIX, DATAFILE_SUFFIX, HINTFILE_SUFFIX, BLOBFILE_SUFFIX} {
+		if strings.HasSuffix(basefn, suffix) {
+			return strconv.Atoi(strings.TrimSuffix(basefn, suffix))
+		}
 	}
-	fileIDString := strings.TrimSuffix(basefn, ext)
-	parts := strings.Split(fileIDString, ".")
-	idPart := parts[0]
-	return strconv.Atoi(idPart)
+	return -1, errors.New("invalid file extension")
+}
+
+func isMergedDatafile(filename string) bool {
+	return strings.HasSuffix(filename, MERGED_DATAFILE_SUFFIX)
 }
 
 func ExtractIDsFromFilenames(filenames []string) []int {